@@ -0,0 +1,209 @@
+// Package api holds the types of Host Monitor's JSON API, so that Go
+// clients can decode its responses without redefining them. The JSON tags
+// are part of the API and are kept stable.
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// HostStatus holds the real-time metrics for a single host, as served by
+// /api/status and /api/hosts/{host}.
+type HostStatus struct {
+	Host string `json:"host"`
+	// DisplayName is a friendlier label for Host, e.g. a URL without its
+	// scheme and query string.
+	DisplayName string    `json:"displayName,omitempty"`
+	Status      string    `json:"status"` // "PENDING" until the first check completes, then "UP", "WARN", "THROTTLED", "DOWN", "UNREACHABLE" or "EXPECTED_DOWN"
+	LatencyMs   float64   `json:"latencyMs"`
+	PacketLoss  float64   `json:"packetLoss"` // Percentage
+	LastCheck   time.Time `json:"lastCheck"`
+	CheckCount  int       `json:"checkCount"`
+	// LastSuccess is the time of the last check that found the host UP, so
+	// that with LastCheck it tells how long an outage has lasted. It is
+	// the zero time until the host has been UP.
+	LastSuccess time.Time `json:"lastSuccess"`
+	// EverUp is set once any check has found the host UP. Until then its
+	// failures are reported as UNREACHABLE rather than DOWN, as they more
+	// likely come from a mistake in its configuration than an outage.
+	EverUp bool `json:"everUp"`
+	// LastTransition is the time Status last changed value. It is left
+	// untouched on checks that report the same status as before.
+	LastTransition time.Time `json:"lastTransition"`
+	// LastError describes why the most recent check failed.
+	LastError string `json:"lastError,omitempty"`
+	// FailureReason classifies LastError.
+	FailureReason FailureReason `json:"failureReason,omitempty"`
+	// Region names the monitor instance that produced this status.
+	Region string `json:"region,omitempty"`
+	// Group gathers related hosts on the dashboard, e.g. the instances of
+	// one discovered service.
+	Group string `json:"group,omitempty"`
+	// UptimePercent is the share of all recorded checks that found the host UP.
+	UptimePercent float64 `json:"uptimePercent"`
+	// MTBF is the mean time between failures: the average time the host
+	// stayed up between two recorded outages. MTTR is the mean time to
+	// recovery, the average length of a finished outage. Both are encoded
+	// in nanoseconds and left out until there is enough history.
+	MTBF time.Duration `json:"mtbf,omitempty"`
+	MTTR time.Duration `json:"mttr,omitempty"`
+	// IntervalMs is the host's check interval.
+	IntervalMs int `json:"intervalMs"`
+	// Metric is an optional custom value reported by the check, e.g. the
+	// number printed by an exec check's command.
+	Metric *float64 `json:"metric,omitempty"`
+	// TLSVersion is the protocol version negotiated by the last HTTPS check.
+	TLSVersion string `json:"tlsVersion,omitempty"`
+	// TLSCipher is the cipher suite negotiated by the last HTTPS check.
+	TLSCipher string `json:"tlsCipher,omitempty"`
+	// ContentEncoding is the Content-Encoding of the last response body,
+	// e.g. gzip. WireBytes is the body's size as transferred and BodyBytes
+	// its size once decoded; they are only known for checks that read the
+	// body (GET and POST), not HEAD.
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	WireBytes       int64  `json:"wireBytes,omitempty"`
+	BodyBytes       int64  `json:"bodyBytes,omitempty"`
+	// Redirects is the number of redirects the last HTTP check followed to
+	// reach its final response.
+	Redirects int `json:"redirects,omitempty"`
+	// Proto is the protocol of the last HTTP check's response, e.g.
+	// HTTP/2.0 or HTTP/1.1.
+	Proto string `json:"proto,omitempty"`
+	// PingSize is the payload size of an icmp host's pings, in bytes. A
+	// host listed at several sizes has a status for each.
+	PingSize int `json:"pingSize,omitempty"`
+	// IPv4Status and IPv6Status are the results of the last check over
+	// each address family with -dual-stack. A family the host has no
+	// addresses in is left out.
+	IPv4Status string `json:"ipv4Status,omitempty"`
+	IPv6Status string `json:"ipv6Status,omitempty"`
+	// Critical hosts make /healthz fail as soon as they are DOWN.
+	Critical bool `json:"critical,omitempty"`
+	// Weight is the host's share in /healthz's weighted DOWN percentage,
+	// when set to other than the default of 1.
+	Weight *float64 `json:"weight,omitempty"`
+	// Schedule is the cron expression the host is checked on, if any; such
+	// hosts have no IntervalMs.
+	Schedule string `json:"schedule,omitempty"`
+	// NotScheduled is set for a scheduled host during hours its schedule
+	// doesn't run in, when its status may be old without being stale.
+	NotScheduled bool `json:"notScheduled,omitempty"`
+	// ExpectedUp is the daily window the host is meant to be up in, if
+	// any, e.g. 08:00-18:00. Outside it, failed checks are EXPECTED_DOWN.
+	ExpectedUp string `json:"expectedUp,omitempty"`
+	// Stale is set when the status is no longer being refreshed, e.g. a
+	// federated peer has stopped answering or LastCheck is older than twice
+	// the check interval.
+	Stale bool `json:"stale,omitempty"`
+	// LatencyHistory holds the latencies of the last few checks, oldest
+	// first. It is only filled in with -include-history.
+	LatencyHistory []float64 `json:"latencyHistory,omitempty"`
+	// LatencyTrend is "up", "down" or "flat" as the latest latencies
+	// compare with their moving average. It is left out until there are
+	// enough checks to tell.
+	LatencyTrend string `json:"latencyTrend,omitempty"`
+	// RetryAt is when a THROTTLED host will next be checked, as requested by
+	// its Retry-After header.
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+	// SLOMs is the host's latency objective in milliseconds (0 = none). A
+	// check breaches it by failing or by taking longer.
+	SLOMs float64 `json:"sloMs,omitempty"`
+	// SLOBreaches counts the checks that breached SLOMs.
+	SLOBreaches int64 `json:"sloBreaches,omitempty"`
+	// SLOBreachPercent is the share of checks within -slo-window that
+	// breached SLOMs.
+	SLOBreachPercent float64 `json:"sloBreachPercent,omitempty"`
+	// SLOTarget is the host's uptime objective in percent (0 = none), e.g.
+	// 99.9. ErrorBudgetRemaining is the percentage of its error budget for
+	// the current calendar month that is left: the budget is the share of
+	// the month's checks that may fail, 100 - SLOTarget percent of them. It
+	// goes below zero once overspent, and is left out until the month's
+	// first check.
+	SLOTarget            float64  `json:"sloTarget,omitempty"`
+	ErrorBudgetRemaining *float64 `json:"errorBudgetRemaining,omitempty"`
+	// MaintenanceUntil is when the host's current maintenance window ends.
+	// Alerts for the host are withheld until then.
+	MaintenanceUntil *time.Time `json:"maintenanceUntil,omitempty"`
+	// AckedAt is when the host's current outage was acknowledged through
+	// /api/hosts/{host}/ack. No more reminders or escalations are sent for
+	// it, and it is cleared when the host is UP again.
+	AckedAt *time.Time `json:"ackedAt,omitempty"`
+}
+
+// FailureReason classifies why a check failed, so that some kinds of
+// failure can be reported as WARN rather than DOWN (see -warn-on).
+type FailureReason string
+
+const (
+	ReasonDNS        FailureReason = "dns"         // The host name did not resolve
+	ReasonRefused    FailureReason = "refused"     // The connection was refused
+	ReasonTimeout    FailureReason = "timeout"     // The check exceeded -timeout
+	ReasonTLS        FailureReason = "tls"         // Handshake or certificate verification failed
+	ReasonTLSWarning FailureReason = "tls_warning" // The certificate has a problem some clients tolerate (-tls-warn)
+	ReasonNetwork    FailureReason = "network"     // Any other connection-level error
+	ReasonHTTPStatus FailureReason = "http_status" // The response status was not healthy
+	ReasonThrottled  FailureReason = "throttled"   // A 429 or 503 asked us to retry later
+	ReasonRedirect   FailureReason = "redirect"    // -expect-redirect did not match
+	ReasonRedirects  FailureReason = "redirects"   // The redirect chain is longer than -max-redirects
+	ReasonProto      FailureReason = "proto"       // The response came over another protocol than the host's proto option
+	ReasonBody       FailureReason = "body"        // The response content did not match (-expect-json, -udp-expect)
+	ReasonExec       FailureReason = "exec"        // An exec check's command failed
+	ReasonInvalid    FailureReason = "invalid"     // The host spec could not be checked at all
+	ReasonAuth       FailureReason = "auth"        // A host's login step failed
+	ReasonPanic      FailureReason = "panic"       // The check itself crashed
+	ReasonPacketLoss FailureReason = "packet_loss" // An icmp check lost -warn-loss or -down-loss percent of its pings
+)
+
+// Summary counts hosts by category. Every host falls in exactly one
+// category, so Up+Warn+Down+Pending always equals Total.
+type Summary struct {
+	Total   int `json:"total"`
+	Up      int `json:"up"`
+	Warn    int `json:"warn"`
+	Down    int `json:"down"`
+	Pending int `json:"pending"`
+	// ExpectedDown counts the hosts that are EXPECTED_DOWN, outside their
+	// expected_up window.
+	ExpectedDown int `json:"expectedDown,omitempty"`
+}
+
+// Error is the body of every error response from /api/*, e.g.
+// {"error": "Unknown host", "code": 404}. Code repeats the HTTP status.
+type Error struct {
+	Message string `json:"error"`
+	Code    int    `json:"code"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// Envelope wraps the statuses served by /api/status and /events with the
+// server's time and the summary counts, so clients can tell how old the
+// data is without relying on their own clock. Hosts is a
+// map[string]HostStatus keyed by host, or a []HostStatus when the request
+// asks for a ?sort order.
+type Envelope[T any] struct {
+	ServerTime time.Time `json:"serverTime"`
+	Hosts      T         `json:"hosts"`
+	Summary    Summary   `json:"summary"`
+	// MaintenanceUntil is when the monitor's global maintenance ends, if
+	// it is in maintenance.
+	MaintenanceUntil *time.Time `json:"maintenanceUntil,omitempty"`
+}
+
+// Delta is the payload of a delta-encoded /events stream (?delta=1),
+// shaped like an Envelope. Full events carry every host and replace the
+// client's state; the others carry only the hosts that changed since the
+// previous event and the keys of hosts that have gone away. The summary
+// always covers every host.
+type Delta struct {
+	Full       bool                  `json:"full,omitempty"`
+	ServerTime time.Time             `json:"serverTime"`
+	Hosts      map[string]HostStatus `json:"hosts"`
+	Removed    []string              `json:"removed,omitempty"`
+	Summary    Summary               `json:"summary"`
+	// MaintenanceUntil is as in Envelope.
+	MaintenanceUntil *time.Time `json:"maintenanceUntil,omitempty"`
+}
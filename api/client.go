@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Status is the response of /api/status: every host's status keyed by host.
+type Status = Envelope[map[string]HostStatus]
+
+// FetchStatus gets the statuses of every host from the monitor at baseURL,
+// e.g. "http://localhost:8080". It is a minimal example of a client; a nil
+// client means http.DefaultClient.
+//
+//	status, err := api.FetchStatus(ctx, nil, "http://localhost:8080")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	for host, s := range status.Hosts {
+//		fmt.Println(host, s.Status, s.LatencyMs)
+//	}
+func FetchStatus(ctx context.Context, client *http.Client, baseURL string) (*Status, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/api/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// The monitor describes its errors in an Error; anything else in
+		// front of it may not
+		apiErr := &Error{Code: resp.StatusCode}
+		if json.NewDecoder(resp.Body).Decode(apiErr) != nil || apiErr.Message == "" {
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil, apiErr
+	}
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return &status, nil
+}
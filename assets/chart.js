@@ -0,0 +1,55 @@
+// latencyChart draws a host's recent checks, as returned by
+// /api/hosts/{host}/history, as an inline SVG time-series chart: latency
+// as a line over time, with failed checks marked in red below it. It needs
+// no libraries so the dashboard works without internet access.
+function latencyChart(checks) {
+    const width = 600, height = 140;
+    const left = 48, right = 8, top = 8, bottom = 20;
+    if (!checks || checks.length < 2) {
+        return '<p class="text-gray-500">Not enough checks yet to chart.</p>';
+    }
+
+    const failed = check => check.status === 'DOWN' || check.status === 'UNREACHABLE';
+    const times = checks.map(check => new Date(check.time).getTime());
+    const start = times[0], span = (times[times.length - 1] - start) || 1;
+    const peak = Math.max(0, ...checks.filter(check => !failed(check)).map(check => check.latencyMs)) || 1;
+    const x = t => (left + (t - start) / span * (width - left - right)).toFixed(1);
+    const y = ms => (top + (1 - ms / peak) * (height - top - bottom)).toFixed(1);
+    const label = (tx, ty, anchor, text) =>
+        '<text x="' + tx + '" y="' + ty + '" text-anchor="' + anchor + '" font-size="10" fill="#6b7280">' + text + '</text>';
+    const clock = t => new Date(t).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+
+    let svg = '<svg class="w-full max-w-2xl" viewBox="0 0 ' + width + ' ' + height + '" role="img" aria-label="Latency history">';
+
+    // Axes, with the peak latency and the time range as the only labels
+    svg += '<line x1="' + left + '" y1="' + top + '" x2="' + left + '" y2="' + (height - bottom) + '" stroke="#d1d5db"></line>' +
+        '<line x1="' + left + '" y1="' + (height - bottom) + '" x2="' + (width - right) + '" y2="' + (height - bottom) + '" stroke="#d1d5db"></line>' +
+        label(left - 4, top + 8, 'end', peak.toFixed(peak < 10 ? 1 : 0) + ' ms') +
+        label(left - 4, height - bottom, 'end', '0') +
+        label(left, height - 6, 'start', clock(start)) +
+        label(width - right, height - 6, 'end', clock(start + span));
+
+    // The line breaks at failed checks, which have no meaningful latency
+    let segment = [];
+    const flush = () => {
+        if (segment.length > 1) {
+            svg += '<polyline fill="none" stroke="#3b82f6" stroke-width="1.5" points="' + segment.join(' ') + '"></polyline>';
+        } else if (segment.length === 1) {
+            const [cx, cy] = segment[0].split(',');
+            svg += '<circle cx="' + cx + '" cy="' + cy + '" r="1.5" fill="#3b82f6"></circle>';
+        }
+        segment = [];
+    };
+    checks.forEach((check, i) => {
+        if (failed(check)) {
+            flush();
+            svg += '<rect x="' + (x(times[i]) - 1.5) + '" y="' + (height - bottom - 6) + '" width="3" height="6" fill="#ef4444">' +
+                '<title>' + check.status + ' at ' + new Date(times[i]).toLocaleTimeString() + '</title></rect>';
+            return;
+        }
+        segment.push(x(times[i]) + ',' + y(check.latencyMs));
+    });
+    flush();
+
+    return svg + '</svg>';
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// canSetDontFragment reports whether setDontFragment works here, which
+// -ping-size and the ping_size option depend on.
+const canSetDontFragment = true
+
+// setDontFragment makes the kernel send conn's packets whole, with the
+// Don't Fragment bit, rather than fragment those larger than the path MTU:
+// sending one then fails, or it is dropped on the way.
+func setDontFragment(conn net.PacketConn, ipv6 bool) error {
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt, value := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO
+	if ipv6 {
+		level, opt, value = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO
+	}
+	var setErr error
+	if err := raw.Control(func(fd uintptr) {
+		setErr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	}); err != nil {
+		return err
+	}
+	if setErr != nil {
+		return fmt.Errorf("cannot disable fragmentation: %w", setErr)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// canSetDontFragment is false outside Linux, where large pings would be
+// fragmented and -ping-size could not find the path MTU.
+const canSetDontFragment = false
+
+// setDontFragment is a no-op outside Linux, where pings take the system's
+// default fragmentation behaviour.
+func setDontFragment(conn net.PacketConn, ipv6 bool) error {
+	return nil
+}
@@ -0,0 +1,3 @@
+module github.com/kellyshumway/HostMonitor
+
+go 1.21
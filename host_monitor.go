@@ -1,247 +1,7969 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"log"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/pprof"
+	"net/netip"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	texttemplate "text/template"
 	"time"
+	_ "time/tzdata" // Zones for -quiet-hours even where the system has no zoneinfo
+
+	"github.com/kellyshumway/HostMonitor/api"
 )
 
-// HostStatus holds the real-time metrics for a single host.
-type HostStatus struct {
-	Host       string    `json:"host"`
-	Status     string    `json:"status"` // "UP" or "DOWN"
-	LatencyMs  float64   `json:"latencyMs"`
-	PacketLoss float64   `json:"packetLoss"` // Percentage
-	LastCheck  time.Time `json:"lastCheck"`
-	CheckCount int       `json:"checkCount"`
-}
+// HostStatus holds the real-time metrics for a single host. It is defined
+// in the api package, with the API's other types, for clients to import.
+type HostStatus = api.HostStatus
 
 // Global state protected by a RWMutex
 var (
 	hostStatuses = make(map[string]HostStatus)
+	// peerStatuses holds the last statuses pulled from each federated peer,
+	// keyed by peer name and then by "host@region".
+	peerStatuses = make(map[string]map[string]HostStatus)
+	// leaderStatuses mirrors the leader's statuses while this instance is
+	// a -follower that hasn't taken over.
+	leaderStatuses map[string]HostStatus
+	// hostStatsMap holds the long-horizon statistics for each local host.
+	hostStatsMap = make(map[string]*hostStats)
 	mu           sync.RWMutex
 )
 
+// Bounds on the per-host history kept in hostStats.
+const (
+	recentChecksSize = 100
+	outageLogSize    = 100
+	changeLogSize    = 500
+	hourlyLogSize    = 5 * 7 * 24 // Five weeks, for week-over-week comparisons
+
+	// Checks are kept as they are for rawHistoryAge (or, for hosts checked
+	// less often, the last recentChecksSize of them), then rolled up into
+	// minutes, which are kept for minuteHistoryAge. Hourly covers the rest.
+	rawHistoryAge    = time.Hour
+	minuteHistoryAge = 24 * time.Hour
+)
+
+// hostStats accumulates a host's metrics across its lifetime, including
+// across restarts when -state-file is used.
+type hostStats struct {
+	TotalChecks int64          `json:"totalChecks"`
+	UpChecks    int64          `json:"upChecks"`
+	Expected    int64          `json:"expectedDownChecks,omitempty"` // EXPECTED_DOWN checks, left out of the uptime
+	LastSuccess time.Time      `json:"lastSuccess"`
+	Recent      []checkSample  `json:"recent"`  // Most recent checks, oldest first
+	Outages     []outage       `json:"outages"` // Most recent outages, oldest first
+	Changes     []statusChange `json:"changes"` // Most recent status changes, oldest first
+	Minutes     []rollup       `json:"minutes"` // Completed minutes older than Recent, oldest first
+	Hourly      []rollup       `json:"hourly"`  // Completed hours, oldest first
+
+	slo     sloTracker        // Not persisted; the window is short compared to a restart
+	latency latencyHistogram  // Not persisted; Prometheus copes with counter resets
+	traffic trafficCounts     // Not persisted, as for latency
+	hour    rollupAccumulator // Not persisted; a restart loses at most the current hour
+}
+
+// trafficCounts totals the traffic checks have caused.
+type trafficCounts struct {
+	Requests      int64 `json:"requests"`
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+}
+
+// add counts one check's traffic.
+func (c *trafficCounts) add(result checkResult) {
+	c.Requests += result.Requests
+	c.BytesSent += result.BytesSent
+	c.BytesReceived += result.BytesReceived
+}
+
+// rollup summarizes a host's checks over one clock minute or hour. Only
+// checks that got a response (UP, WARN or THROTTLED) contribute latencies,
+// so a run of timeouts shows up in Failed rather than as a spike in P95Ms.
+type rollup struct {
+	Start   time.Time `json:"start"`
+	Checks  int       `json:"checks"`
+	Up      int       `json:"up"`
+	Failed  int       `json:"failed"`
+	MinMs   float64   `json:"minMs"`
+	AvgMs   float64   `json:"avgMs"`
+	P50Ms   float64   `json:"p50Ms"`
+	P95Ms   float64   `json:"p95Ms"`
+	MaxMs   float64   `json:"maxMs"`
+	Partial bool      `json:"partial,omitempty"` // The period is still in progress
+	// Expected counts the EXPECTED_DOWN checks, which are left out of
+	// Failed and UptimePercent.
+	Expected int `json:"expected,omitempty"`
+	// UptimePercent is the share of the checks that found the host UP.
+	UptimePercent float64 `json:"uptimePercent"`
+}
+
+// fillUp sets Up for a rollup saved before it was kept, recovering it from
+// the uptime. That is exact for periods of less than 10000 checks.
+func (r *rollup) fillUp() {
+	if r.Up > 0 || r.UptimePercent == 0 {
+		return
+	}
+	// UptimePercent is truncated, so the count is the next whole number
+	r.Up = int(math.Ceil(r.UptimePercent*float64(r.Checks-r.Expected)/100 - 1e-6))
+}
+
+// rollupAccumulator collects the checks of a period being rolled up.
+type rollupAccumulator struct {
+	start     time.Time
+	checks    int
+	up        int
+	expected  int
+	latencies []float64
+}
+
+// add counts one check.
+func (a *rollupAccumulator) add(sample checkSample) {
+	a.checks++
+	switch sample.Status {
+	case "UP":
+		a.up++
+	case expectedDownStatus:
+		a.expected++
+	}
+	if category := statusCategory(sample.Status); category == "up" || category == "warn" {
+		a.latencies = append(a.latencies, sample.LatencyMs)
+	}
+}
+
+// summary returns the accumulated period as a rollup.
+func (a *rollupAccumulator) summary() rollup {
+	period := rollup{Start: a.start, Checks: a.checks, Up: a.up, Failed: a.checks - a.expected - len(a.latencies), Expected: a.expected}
+	if counted := a.checks - a.expected; counted > 0 {
+		period.UptimePercent = float64(int(float64(a.up)/float64(counted)*10000)) / 100.0 // Round to 2 decimals
+	}
+	if len(a.latencies) > 0 {
+		sorted := slices.Clone(a.latencies)
+		slices.Sort(sorted)
+		var sum float64
+		for _, ms := range sorted {
+			sum += ms
+		}
+		period.MinMs = sorted[0]
+		period.AvgMs = float64(int(sum/float64(len(sorted))*100)) / 100.0 // Round to 2 decimals
+		period.P50Ms = percentile(sorted, 50)
+		period.P95Ms = percentile(sorted, 95)
+		period.MaxMs = sorted[len(sorted)-1]
+	}
+	return period
+}
+
+// rollUp summarizes the given checks, oldest first, by the clock period
+// (a minute or an hour) they fall in.
+func rollUp(samples []checkSample, period time.Duration) []rollup {
+	var periods []rollup
+	var acc rollupAccumulator
+	for _, sample := range samples {
+		if start := sample.Time.Truncate(period); !start.Equal(acc.start) {
+			if acc.checks > 0 {
+				periods = append(periods, acc.summary())
+			}
+			acc = rollupAccumulator{start: start}
+		}
+		acc.add(sample)
+	}
+	if acc.checks > 0 {
+		periods = append(periods, acc.summary())
+	}
+	return periods
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted, which must
+// not be empty.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the /metrics latency
+// histogram buckets. An implicit +Inf bucket follows.
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// latencyHistogram counts a host's check latencies for /metrics. Each
+// bucket keeps the most recent check that fell in it as an exemplar, so a
+// spike can be traced to the check (and, with -traceparent, the trace)
+// behind it.
+type latencyHistogram struct {
+	counts    [len(latencyBuckets) + 1]uint64 // Per bucket, not cumulative
+	exemplars [len(latencyBuckets) + 1]*exemplar
+	sum       float64
+}
+
+// exemplar is one observed latency and the check it came from.
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+// observe adds a latency in seconds.
+func (h *latencyHistogram) observe(seconds float64, traceID string, now time.Time) {
+	bucket, _ := slices.BinarySearch(latencyBuckets[:], seconds)
+	h.counts[bucket]++
+	h.sum += seconds
+	if traceID != "" {
+		h.exemplars[bucket] = &exemplar{traceID: traceID, value: seconds, time: now}
+	}
+}
+
+// sloTracker keeps a host's latency SLO results over the rolling
+// -slo-window.
+type sloTracker struct {
+	samples  []sloSample // Oldest first
+	breaches int         // Number of samples that breached
+	burning  bool        // Whether a burn alert is outstanding
+}
+
+// sloSample is one check's SLO result.
+type sloSample struct {
+	time     time.Time
+	breached bool
+}
+
+// record adds a check result, drops results that have left the window, and
+// returns the percentage of the remaining ones that breached.
+func (t *sloTracker) record(now time.Time, breached bool, window time.Duration) float64 {
+	t.samples = append(t.samples, sloSample{time: now, breached: breached})
+	if breached {
+		t.breaches++
+	}
+
+	cutoff := now.Add(-window)
+	drop := 0
+	for drop < len(t.samples) && t.samples[drop].time.Before(cutoff) {
+		if t.samples[drop].breached {
+			t.breaches--
+		}
+		drop++
+	}
+	t.samples = t.samples[drop:]
+
+	return float64(int(float64(t.breaches)/float64(len(t.samples))*1000)) / 10.0 // Round to 1 decimal
+}
+
+// checkSample is one entry in a host's recent check history.
+type checkSample struct {
+	Time      time.Time `json:"time"`
+	Status    string    `json:"status"`
+	LatencyMs float64   `json:"latencyMs"`
+}
+
+// statusChange records a host taking on a new status, starting with its
+// first check.
+type statusChange struct {
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+}
+
+// outage records a period during which a host was not UP. End is zero while
+// the outage is ongoing.
+type outage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitempty"`
+}
+
+// uptimePercent returns the share of recorded checks that were UP, leaving
+// out those that were EXPECTED_DOWN.
+func (s *hostStats) uptimePercent() float64 {
+	counted := s.TotalChecks - s.Expected
+	if counted == 0 {
+		return 0
+	}
+	return float64(int(float64(s.UpChecks)/float64(counted)*10000)) / 100.0 // Round to 2 decimals
+}
+
+// errorBudgetRemaining returns the percentage of the error budget for the
+// current calendar month, in the local time zone, that is left under an
+// uptime objective of target percent, or nil before the month's first
+// check. The budget starts over with each month. Completed hours are
+// counted from the hourly rollups, which cover more than a month and keep
+// their UP checks.
+func (s *hostStats) errorBudgetRemaining(target float64, now time.Time) *float64 {
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	var checks, up int
+	if !s.hour.start.Before(monthStart) {
+		checks, up = s.hour.checks-s.hour.expected, s.hour.up
+	}
+	for i := len(s.Hourly) - 1; i >= 0 && !s.Hourly[i].Start.Before(monthStart); i-- {
+		checks += s.Hourly[i].Checks - s.Hourly[i].Expected
+		up += s.Hourly[i].Up
+	}
+	if checks == 0 {
+		return nil
+	}
+	failedPercent := float64(checks-up) * 100 / float64(checks)
+	remaining := math.Round((1-failedPercent/(100-target))*10000) / 100 // Percent, to 2 decimals
+	return &remaining
+}
+
+// reliability returns the mean time between failures and the mean time to
+// recovery, computed from the outage log. Either is zero when there are not
+// yet enough outages to measure it.
+func (s *hostStats) reliability() (mtbf, mttr time.Duration) {
+	var repair, between time.Duration
+	var repaired, gaps int
+	for i, o := range s.Outages {
+		if !o.End.IsZero() {
+			repair += o.End.Sub(o.Start)
+			repaired++
+		}
+		if i > 0 && !s.Outages[i-1].End.IsZero() {
+			between += o.Start.Sub(s.Outages[i-1].End)
+			gaps++
+		}
+	}
+	if gaps > 0 {
+		mtbf = between / time.Duration(gaps)
+	}
+	if repaired > 0 {
+		mttr = repair / time.Duration(repaired)
+	}
+	return mtbf, mttr
+}
+
+// record adds a check to the stats, logging a change when its status
+// differs from the last one, opening an outage on the first failed check
+// and closing it on the next UP one.
+func (s *hostStats) record(sample checkSample) {
+	s.TotalChecks++
+	switch sample.Status {
+	case "UP":
+		s.UpChecks++
+		s.LastSuccess = sample.Time
+	case expectedDownStatus:
+		s.Expected++
+	}
+
+	// Trimmed to rawHistoryAge by compactHistory
+	s.Recent = append(s.Recent, sample)
+
+	if start := sample.Time.Truncate(time.Hour); !start.Equal(s.hour.start) {
+		if s.hour.checks > 0 {
+			s.Hourly = append(s.Hourly, s.hour.summary())
+			if len(s.Hourly) > hourlyLogSize {
+				s.Hourly = s.Hourly[len(s.Hourly)-hourlyLogSize:]
+			}
+		}
+		s.hour = rollupAccumulator{start: start}
+	}
+	s.hour.add(sample)
+
+	if len(s.Changes) == 0 || s.Changes[len(s.Changes)-1].Status != sample.Status {
+		s.Changes = append(s.Changes, statusChange{Time: sample.Time, Status: sample.Status})
+		if len(s.Changes) > changeLogSize {
+			s.Changes = s.Changes[len(s.Changes)-changeLogSize:]
+		}
+	}
+
+	// An outage restored from -state-file may still be open
+	inOutage := len(s.Outages) > 0 && s.Outages[len(s.Outages)-1].End.IsZero()
+	switch {
+	case !endsOutage(sample.Status) && !inOutage:
+		s.Outages = append(s.Outages, outage{Start: sample.Time})
+		if len(s.Outages) > outageLogSize {
+			s.Outages = s.Outages[len(s.Outages)-outageLogSize:]
+		}
+	case endsOutage(sample.Status) && inOutage:
+		s.Outages[len(s.Outages)-1].End = sample.Time
+	}
+}
+
+// compactHistory rolls the checks older than rawHistoryAge up into
+// minutes, keeping at least the last recentChecksSize of them as they are,
+// and drops the minutes older than minuteHistoryAge. Only whole minutes are
+// rolled up, so that each is summarized once.
+func (s *hostStats) compactHistory(now time.Time) {
+	cutoff := now.Add(-rawHistoryAge)
+	drop := sort.Search(len(s.Recent), func(i int) bool { return !s.Recent[i].Time.Before(cutoff) })
+	drop = min(drop, max(len(s.Recent)-recentChecksSize, 0))
+	for drop > 0 && s.Recent[drop].Time.Truncate(time.Minute).Equal(s.Recent[drop-1].Time.Truncate(time.Minute)) {
+		drop--
+	}
+	if drop > 0 {
+		s.Minutes = append(s.Minutes, rollUp(s.Recent[:drop], time.Minute)...)
+		s.Recent = slices.Clone(s.Recent[drop:]) // Let the rolled-up checks be freed
+	}
+
+	cutoff = now.Add(-minuteHistoryAge)
+	if old := sort.Search(len(s.Minutes), func(i int) bool { return !s.Minutes[i].Start.Before(cutoff) }); old > 0 {
+		s.Minutes = slices.Clone(s.Minutes[old:])
+	}
+}
+
+// compactHistories runs compactHistory over every host once a minute until
+// ctx is cancelled.
+func compactHistories(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			mu.Lock()
+			for _, stats := range hostStatsMap {
+				stats.compactHistory(now)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
 // Command line flags
 var (
-	hostsStr   string
-	port       int
-	intervalMs int
+	hostsStr           string
+	port               int
+	bindAddr           string
+	intervalMs         int
+	followRedirects    bool
+	maxRedirects       int
+	disableCompression bool
+	dualStack          bool
+	expectRedirect     string
+	region             string
+	peersStr           string
+	follower           bool
+	leaderURL          string
+	failoverAfter      time.Duration
+	checkMethod        string
+	requestBody        string
+	requestBodyFile    string
+	contentType        string
+	expectJSON         string
+	rateLimit          float64
+	jitterPercent      float64
+	checkType          string
+	udpPayload         string
+	udpExpect          string
+	tcpSend            string
+	tcpExpect          string
+	tcpHold            time.Duration
+	pingCount          int
+	pingSize           int
+	warnLoss           float64
+	downLoss           float64
+	timeoutMs          int
+	stepTimeoutMs      int
+	execMetric         bool
+	minTLS             string
+	tlsWarn            bool
+	clientCertFile     string
+	clientKeyFile      string
+	webhookURL         string
+	webhookMethod      string
+	webhookTemplate    string
+	slackWebhookURL    string
+	pagerDutyKey       string
+	pagerDutyURL       string
+	smtpAddr           string
+	smtpUser           string
+	smtpPassword       string
+	emailFrom          string
+	emailTo            string
+
+	alertGroupWindow    time.Duration
+	alertRepeatInterval time.Duration
+	webhookAfter        time.Duration
+	quietHoursSpec      string
+	slackAfter          time.Duration
+	emailAfter          time.Duration
+	pagerDutyAfter      time.Duration
+	unreachableNotify   string
+	incidentWindow      time.Duration
+	incidentMinHosts    int
+	resultWebhook       string
+	resultBatchWindow   time.Duration
+	resultBatchSize     int
+
+	stateFilePath  string
+	hostsFile      string
+	hostsURL       string
+	hostsRefresh   time.Duration
+	consulURL      string
+	consulServices string
+	consulTag      string
+	consulScheme   string
+	consulPath     string
+	workers        int
+	debugToken     string
+	adminToken     string
+	pprofAddr      string
+	unixSocket     string
+	warnOn         string
+	socks5Addr     string
+	resolverAddr   string
+	sourceIP       string
+	maxRetryAfter  time.Duration
+	includeHistory bool
+	hidePending    bool
+	dashboardPoll  time.Duration // How often the dashboard polls /api/status while live updates fail
+	nagiosHost     string
+	validateOnly   bool
+	emitLog        string
+
+	sendTraceparent bool
+
+	sloWindow       time.Duration
+	sloAlertPercent float64
+	sloTarget       float64
+	healthThreshold float64
+
+	// Dashboard latency colouring, in milliseconds (0 = off)
+	latencyWarnMs float64
+	latencyCritMs float64
+)
+
+// maxBodyBytes bounds how much of a response body is read when a check
+// needs to inspect it.
+const maxBodyBytes = 1 << 20
+
+// expectJSONPath and expectJSONValue are parsed from -expect-json.
+var (
+	expectJSONPath  []string
+	expectJSONValue string
 )
 
+// expectRedirectRe is compiled from -expect-redirect when it is given as a
+// "~regexp" pattern rather than an exact URL.
+var expectRedirectRe *regexp.Regexp
+
 func init() {
 	// Initialize command line flags
-	flag.StringVar(&hostsStr, "hosts", "actiontarget.com, ksl.com, github.com", "Comma-separated list of hosts to monitor")
-	flag.IntVar(&port, "port", 8080, "Port for the web dashboard")
+	flag.StringVar(&hostsStr, "hosts", "actiontarget.com, ksl.com, github.com", "Comma-separated list of hosts to monitor, each optionally as name=host and followed by ;option=value pairs")
+	flag.StringVar(&hostsURL, "hosts-url", "", "URL serving a JSON array or newline list of host specs to monitor in addition to -hosts/-hosts-file")
+	flag.DurationVar(&hostsRefresh, "hosts-refresh", time.Minute, "How often to reread -hosts-file, -hosts-url and -consul-services and start or stop monitors to match (0 = only at startup)")
+	flag.StringVar(&consulServices, "consul-services", "", "Comma-separated Consul services whose healthy instances are monitored, grouped by service (token from CONSUL_HTTP_TOKEN)")
+	flag.StringVar(&consulURL, "consul-url", "http://127.0.0.1:8500", "Consul HTTP API address for -consul-services")
+	flag.StringVar(&consulTag, "consul-tag", "", "Only monitor -consul-services instances with this tag")
+	flag.StringVar(&consulScheme, "consul-scheme", "http", "Scheme for http checks of -consul-services instances (http or https)")
+	flag.StringVar(&consulPath, "consul-path", "", "Path for http checks of -consul-services instances, e.g. /health")
+	flag.StringVar(&hostsFile, "hosts-file", "", "File listing one host spec per line (# comments allowed), appended to -hosts and reread every -hosts-refresh")
+	flag.IntVar(&port, "port", 8080, "Port for the web dashboard (0 = any free port, logged at startup)")
+	flag.StringVar(&bindAddr, "bind", "", "IP address the web dashboard listens on, e.g. 127.0.0.1 (default all interfaces)")
+	flag.StringVar(&unixSocket, "unix-socket", "", "Also serve the dashboard and API on this Unix socket (mode 0660); TCP is then off unless -port or -bind is given")
 	flag.IntVar(&intervalMs, "interval", 2000, "Monitoring interval in milliseconds")
+	flag.StringVar(&checkType, "check", "http", "Check type: http, exec to run each host spec as a command (exit 0 = UP), tcp to connect to host:port, udp to probe host:port with -udp-payload, or icmp to ping each host")
+	flag.StringVar(&udpPayload, "udp-payload", "", "Datagram sent by udp checks (use a hex: prefix for binary payloads)")
+	flag.StringVar(&udpExpect, "udp-expect", "", "Substring the reply to a udp check must contain (hex: prefix for binary; empty = any reply)")
+	flag.StringVar(&tcpSend, "tcp-send", "", "Probe sent once a tcp check has connected (hex: prefix for binary); the check then waits for a reply and measures its round trip")
+	flag.StringVar(&tcpExpect, "tcp-expect", "", "Substring a tcp check's reply must contain, e.g. a banner for services that speak first (hex: prefix for binary; empty = any reply after -tcp-send)")
+	flag.DurationVar(&tcpHold, "tcp-hold", 0, "Keep each tcp check's connection open this long after connecting (and probing), and report DOWN if the host closes or resets it meanwhile")
+	flag.IntVar(&pingCount, "ping-count", 3, "Echo requests sent by each icmp check; packet loss is measured over them")
+	flag.IntVar(&pingSize, "ping-size", 8, "Payload bytes of each icmp echo request (8-65507; Linux only). Pings are sent with Don't Fragment, so sizes above the path MTU fail; list a host again with a ping_size option to compare")
+	flag.Float64Var(&warnLoss, "warn-loss", 0, "Report an icmp host as WARN when at least this percentage of its pings are lost (0 = off)")
+	flag.Float64Var(&downLoss, "down-loss", 100, "Report an icmp host as DOWN when at least this percentage of its pings are lost")
+	flag.DurationVar(&maxRetryAfter, "max-retry-after", 10*time.Minute, "Longest a 429/503 Retry-After header may postpone a host's next check")
+	flag.IntVar(&timeoutMs, "timeout", 5000, "Overall deadline for a single check, including all of its steps, in milliseconds")
+	flag.IntVar(&stepTimeoutMs, "step-timeout", 0, "Timeout for each step of a check (login, request) in milliseconds (0 = only -timeout applies)")
+	flag.BoolVar(&execMetric, "exec-metric", false, "For exec checks, parse the first number printed on stdout into the host's metric")
+	flag.StringVar(&sourceIP, "source-ip", "", "Local address to send checks from (hosts can override it with ;source=<ip>)")
+	flag.StringVar(&resolverAddr, "resolver", "", "Resolve host names for checks against this DNS server, as IP[:port], instead of the system resolver")
+	flag.StringVar(&socks5Addr, "socks5", "", "Send HTTP checks through this SOCKS5 proxy, as [user:password@]host:port")
+	flag.StringVar(&minTLS, "min-tls", "", "Minimum TLS version for HTTPS checks (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&clientCertFile, "client-cert", "", "PEM client certificate presented to HTTPS hosts that require mutual TLS (reloaded when it changes; per-host cert= overrides)")
+	flag.StringVar(&clientKeyFile, "client-key", "", "PEM private key for -client-cert (per-host key= overrides)")
+	flag.BoolVar(&tlsWarn, "tls-warn", false, "Report certificate problems some clients tolerate (missing intermediate, Common Name only) as WARN instead of DOWN")
+	flag.BoolVar(&dualStack, "dual-stack", false, "Check HTTP hosts over both IPv4 and IPv6, on fresh connections, and report WARN when only one works")
+	flag.BoolVar(&disableCompression, "disable-compression", false, "Don't ask HTTP hosts for gzip-compressed responses, so bodies are transferred (and measured) uncompressed")
+	flag.BoolVar(&followRedirects, "follow-redirects", true, "Follow HTTP redirects; when false a 3xx response counts as UP")
+	flag.IntVar(&maxRedirects, "max-redirects", 0, "Report WARN when an HTTP check follows more than this many redirects (0 = off)")
+	flag.StringVar(&expectRedirect, "expect-redirect", "", "Expected redirect Location (exact URL, or ~regexp); implies -follow-redirects=false")
+	flag.StringVar(&region, "region", "", "Region name attached to the hosts monitored by this instance")
+	flag.StringVar(&checkMethod, "method", "HEAD", "HTTP method used for checks (HEAD, GET or POST)")
+	flag.StringVar(&requestBody, "body", "", "Request body sent by POST checks")
+	flag.StringVar(&requestBodyFile, "body-file", "", "File whose contents are sent as the body of POST checks")
+	flag.StringVar(&contentType, "content-type", "application/json", "Content-Type of the -body or -body-file payload")
+	flag.StringVar(&warnOn, "warn-on", "", "Comma-separated failure reasons reported as WARN instead of DOWN (dns, refused, timeout, tls, network, http_status, redirect, body, exec, invalid, panic)")
+	flag.StringVar(&expectJSON, "expect-json", "", "Assert a JSON field in the response body, e.g. db.status=ok (implies -method GET)")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "Maximum outbound checks per second across all hosts (0 = unlimited)")
+	flag.Float64Var(&jitterPercent, "jitter-percent", 0, "Randomly vary each check interval by up to this percentage (0-100)")
+	flag.StringVar(&webhookURL, "webhook-url", "", "URL to POST a JSON event to when a host changes status")
+	flag.StringVar(&webhookMethod, "webhook-method", http.MethodPost, "HTTP method for -webhook-url requests: POST, PUT or PATCH")
+	flag.StringVar(&webhookTemplate, "webhook-template-file", "", "Build -webhook-url request bodies from this Go text/template, executed with each event; {{json .Field}} quotes a value for JSON")
+	flag.Func("webhook-header", "Add a header to -webhook-url requests, as \"Name: value\" (repeatable)", func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return fmt.Errorf("%q must be Name: value", s)
+		}
+		webhookHeaders.Add(name, strings.TrimSpace(value))
+		return nil
+	})
+	flag.StringVar(&slackWebhookURL, "slack-webhook", "", "Slack incoming webhook URL for status change alerts")
+	flag.StringVar(&pagerDutyKey, "pagerduty-key", "", "PagerDuty Events API v2 routing key; failures trigger an incident per host and recoveries resolve it")
+	flag.StringVar(&pagerDutyURL, "pagerduty-url", "https://events.pagerduty.com/v2/enqueue", "PagerDuty Events API v2 endpoint")
+	flag.StringVar(&smtpAddr, "smtp-addr", "", "SMTP server (host:port) for email alerts")
+	flag.StringVar(&smtpUser, "smtp-user", "", "SMTP username (enables PLAIN auth)")
+	flag.StringVar(&smtpPassword, "smtp-password", "", "SMTP password")
+	flag.StringVar(&emailFrom, "email-from", "", "Sender address for email alerts")
+	flag.StringVar(&emailTo, "email-to", "", "Comma-separated recipients for email alerts")
+	flag.StringVar(&quietHoursSpec, "quiet-hours", "", "Hold alerts in this daily range, e.g. 22:00-07:00@Europe/London, and send them as a digest afterwards (hosts can override with ;quiet=)")
+	flag.DurationVar(&webhookAfter, "webhook-after", 0, "Only send failures to -webhook-url once a host has been failing this long (e.g. 5m)")
+	flag.DurationVar(&slackAfter, "slack-after", 0, "Only send failures to -slack-webhook once a host has been failing this long")
+	flag.DurationVar(&emailAfter, "email-after", 0, "Only send failures by email once a host has been failing this long")
+	flag.DurationVar(&pagerDutyAfter, "pagerduty-after", 0, "Only trigger PagerDuty incidents once a host has been failing this long")
+	flag.StringVar(&unreachableNotify, "unreachable-notify", "all", "Notifiers to alert about hosts that have never been UP (UNREACHABLE): a comma-separated list of webhook, slack, email and pagerduty, or all or none")
+	flag.StringVar(&resultWebhook, "result-webhook", "", "URL to POST every check's resulting host status to, in batches, e.g. for a time-series collector (unlike -webhook-url, which only gets status changes)")
+	flag.DurationVar(&incidentWindow, "incident-window", 30*time.Second, "Group hosts that start failing within this long of each other into one incident, listed at /api/incidents (0 = off). When set explicitly, an incident's failures are also alerted on as one, at the cost of every failure alert waiting this long to be grouped")
+	flag.IntVar(&incidentMinHosts, "incident-min-hosts", 3, "How many hosts must fail within -incident-window to make an incident")
+	flag.DurationVar(&resultBatchWindow, "result-batch-window", 5*time.Second, "How long -result-webhook collects results before sending them as one batch")
+	flag.IntVar(&resultBatchSize, "result-batch-size", 100, "Send a -result-webhook batch early once it holds this many results")
+	flag.DurationVar(&alertGroupWindow, "alert-group-window", 0, "Group alerts occurring within this window into one digest (e.g. 30s; 0 sends immediately)")
+	flag.DurationVar(&alertRepeatInterval, "alert-repeat-interval", 0, "Re-send an alert for a host still failing after this long (e.g. 1h; 0 never repeats)")
+	flag.DurationVar(&sloWindow, "slo-window", time.Hour, "Rolling window over which latency SLO breaches (per-host slo_ms) are measured")
+	flag.Float64Var(&sloAlertPercent, "slo-alert-percent", 10, "Alert when more than this percentage of a host's checks in -slo-window breach its slo_ms")
+	flag.Float64Var(&sloTarget, "slo-target", 0, "Uptime objective in percent, e.g. 99.9, whose monthly error budget is tracked for each host (0 = off; per-host slo_target overrides)")
+	flag.Float64Var(&healthThreshold, "health-threshold", 50, "/healthz answers 503 once this weighted percentage of hosts is DOWN (per-host weight=; any critical=true host DOWN fails it too)")
+	flag.Float64Var(&latencyWarnMs, "latency-warn-ms", 200, "Show latencies at or above this many milliseconds in amber on the dashboard (0 = off)")
+	flag.Float64Var(&latencyCritMs, "latency-crit-ms", 1000, "Show latencies at or above this many milliseconds in red on the dashboard (0 = off)")
+	flag.BoolVar(&includeHistory, "include-history", false, "Include each host's last 20 latencies in status payloads, for the dashboard's sparklines")
+	flag.DurationVar(&dashboardPoll, "dashboard-poll-interval", 5*time.Second, "How often the dashboard polls for statuses when live updates (SSE) fail, e.g. behind a proxy that breaks streaming")
+	flag.BoolVar(&hidePending, "hide-pending", false, "Leave hosts out of the dashboard, API summaries and /metrics until their first check completes")
+	flag.BoolVar(&sendTraceparent, "traceparent", false, "Send a W3C traceparent header with each HTTP check and use its trace ID for /metrics exemplars")
+	flag.StringVar(&emitLog, "emit-log", "", "Write a JSON line to stdout for every check (checks) or status change (transitions)")
+	flag.StringVar(&nagiosHost, "nagios", "", "Check this one host spec, print the result in Nagios plugin format and exit with its status code")
+	flag.BoolVar(&validateOnly, "validate", false, "Check the flags, host specs, notifier settings and dashboard template, print any errors and exit, without binding a port or sending any traffic")
+	flag.IntVar(&workers, "workers", 0, "Run checks on a pool of this many workers instead of one goroutine per host (0 = per-host goroutines)")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required for mutating API requests (POST, PUT, PATCH, DELETE); reads stay open (empty = no check)")
+	flag.StringVar(&debugToken, "debug-token", "", "Bearer token required to access /debug/stats (empty = open)")
+	flag.StringVar(&pprofAddr, "pprof", "", "Serve net/http/pprof on this separate address, e.g. localhost:6060 (empty = disabled)")
+	flag.StringVar(&stateFilePath, "state-file", "", "File to save per-host stats to on shutdown and restore them from on startup")
+	flag.StringVar(&peersStr, "peers", "", "Comma-separated list of peer instances to aggregate ([name=]http://host:port)")
+	flag.BoolVar(&follower, "follower", false, "Stand by for -leader-url: mirror its statuses without checking or alerting, and take over if it is unreachable for -failover-after")
+	flag.StringVar(&leaderURL, "leader-url", "", "Base URL of the instance a -follower mirrors, e.g. http://monitor-a:8080")
+	flag.DurationVar(&failoverAfter, "failover-after", time.Minute, "How long the -leader-url must be unreachable before a -follower takes over")
 }
 
-// monitorHost simulates pinging a host and updates the global status map.
-// NOTE: In a production application, replace the simulation with an actual ICMP library.
-func monitorHost(host string, interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// checkLimiter caps the rate of outbound checks across all hosts. It is nil
+// when -rate-limit is unset.
+var checkLimiter *rateLimiter
 
-	mu.Lock()
-	hostStatuses[host] = HostStatus{
-		Host:       host,
-		Status:     "INIT",
-		LatencyMs:  0,
-		PacketLoss: 0,
-		// LastCheck defaults to zero time (0001-01-01T00:00:00Z)
+// rateLimiter is a token bucket: tokens refill at rate per second up to
+// burst, and each check consumes one.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate events per second. The
+// burst size is one second's worth of events (at least one).
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := math.Max(1, math.Floor(rate))
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait reserves a token, sleeping until it becomes available, and returns
+// how long the caller was delayed.
+func (l *rateLimiter) wait() time.Duration {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// Taking the token now (possibly going negative) queues waiters fairly
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return delay
+}
+
+// checkResult is the outcome of a single check of a host.
+type checkResult struct {
+	Status     string
+	LatencyMs  float64
+	PacketLoss float64
+	Metric     *float64
+	TLSVersion string
+	TLSCipher  string
+	// The response body's Content-Encoding and its size as transferred and
+	// once decoded, when the check read it
+	ContentEncoding string
+	WireBytes       int64
+	BodyBytes       int64
+	Redirects       int           // Redirects followed to reach the final response
+	Proto           string        // Protocol of the HTTP response, e.g. HTTP/2.0
+	IPv4Status      string        // Status over IPv4 with -dual-stack, empty if the host has no IPv4 address
+	IPv6Status      string        // Likewise over IPv6
+	Requests        int64         // Requests, connections or pings the check sent
+	BytesSent       int64         // Traffic the check sent, as far as it can be measured
+	BytesReceived   int64         // Likewise for the traffic received
+	Err             string        // Reason for a DOWN result, empty when UP
+	Reason          FailureReason // Classification of Err
+	RetryAfter      time.Duration // Delay requested by a THROTTLED response, capped at -max-retry-after
+	TraceID         string        // Trace ID sent in the traceparent header, with -traceparent
+}
+
+// FailureReason classifies why a check failed, so that some kinds of
+// failure can be reported as WARN rather than DOWN (see -warn-on).
+type FailureReason = api.FailureReason
+
+const (
+	ReasonDNS        = api.ReasonDNS
+	ReasonRefused    = api.ReasonRefused
+	ReasonTimeout    = api.ReasonTimeout
+	ReasonTLS        = api.ReasonTLS
+	ReasonTLSWarning = api.ReasonTLSWarning
+	ReasonNetwork    = api.ReasonNetwork
+	ReasonHTTPStatus = api.ReasonHTTPStatus
+	ReasonThrottled  = api.ReasonThrottled
+	ReasonRedirect   = api.ReasonRedirect
+	ReasonRedirects  = api.ReasonRedirects
+	ReasonProto      = api.ReasonProto
+	ReasonBody       = api.ReasonBody
+	ReasonExec       = api.ReasonExec
+	ReasonInvalid    = api.ReasonInvalid
+	ReasonAuth       = api.ReasonAuth
+	ReasonPanic      = api.ReasonPanic
+	ReasonPacketLoss = api.ReasonPacketLoss
+)
+
+// failureReasons lists every FailureReason that can make a check DOWN, for
+// validating -warn-on. ReasonTLSWarning, ReasonRedirects and ReasonProto are
+// left out as they are always WARN.
+var failureReasons = []FailureReason{
+	ReasonDNS, ReasonRefused, ReasonTimeout, ReasonTLS, ReasonNetwork,
+	ReasonHTTPStatus, ReasonThrottled, ReasonRedirect, ReasonBody, ReasonExec, ReasonInvalid, ReasonAuth, ReasonPanic,
+	ReasonPacketLoss,
+}
+
+// warnReasons holds the failure reasons reported as WARN, parsed from
+// -warn-on.
+var warnReasons = make(map[FailureReason]bool)
+
+// parseWarnOn parses a comma-separated list of failure reasons.
+func parseWarnOn(spec string) (map[FailureReason]bool, error) {
+	reasons := make(map[FailureReason]bool)
+	for _, name := range strings.Split(spec, ",") {
+		reason := FailureReason(strings.TrimSpace(name))
+		if reason == "" {
+			continue
+		}
+		if !slices.Contains(failureReasons, reason) {
+			return nil, fmt.Errorf("unknown failure reason %q", reason)
+		}
+		reasons[reason] = true
+	}
+	return reasons, nil
+}
+
+// classifyError maps an error from an HTTP request to a FailureReason.
+func classifyError(err error) FailureReason {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var netErr net.Error
+	var opErr *net.OpError
+	var loginErr *loginError
+	var clientCertErr *clientCertError
+	switch {
+	case errors.As(err, &loginErr):
+		return ReasonAuth
+	case errors.As(err, &clientCertErr):
+		return ReasonTLS
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		// An alert from the server, e.g. a client certificate it rejected
+		return ReasonTLS
+	case errors.As(err, &dnsErr):
+		return ReasonDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonRefused
+	case errors.As(err, &certErr), errors.As(err, &alertErr), errors.As(err, &recordErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &invalidCert):
+		return ReasonTLS
+	default:
+		return ReasonNetwork
+	}
+}
+
+// tlsVersions maps -min-tls values to crypto/tls version constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newCheckClient builds the HTTP client shared by a host's checks. A source
+// address binds its connections to that local address, and a login option
+// gives it a session of its own.
+func newCheckClient(spec hostSpec) *http.Client {
+	options := spec.Options
+	source := options.source()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second, // As in http.DefaultTransport
+		KeepAlive: 30 * time.Second,
+		Resolver:  checkResolver,
+	}
+	if source.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: source.AsSlice()}
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if forced, ok := ctx.Value(dialNetworkKey{}).(string); ok {
+			network = forced
+		}
+		var conn net.Conn
+		var err error
+		if options.Proxy != nil {
+			conn, err = dialConnect(ctx, dialer, network, options.Proxy, addr)
+		} else {
+			conn, err = dialer.DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Counted from the start, so the TLS handshake is included
+		counted := &countingConn{Conn: conn}
+		if meter, ok := ctx.Value(trafficMeterKey{}).(*trafficMeter); ok {
+			counted.meter.Store(meter)
+		}
+		return counted, nil
+	}
+	if dualStack {
+		// Pooled connections are shared by both families' checks, so each
+		// check dials afresh to be sure it used the family it was meant to
+		transport.DisableKeepAlives = true
+	}
+	// performCheck asks for gzip itself and decodes the body, so it can
+	// measure the response both as transferred and as decoded
+	transport.DisableCompression = true
+	transport.TLSClientConfig = &tls.Config{
+		// Hosts that only offer older protocols fail the handshake and show DOWN
+		MinVersion: tlsVersions[minTLS],
+		// Empty unless the host has an sni option, when its certificate is
+		// verified against that name instead of the URL's host
+		ServerName: options.SNI,
+	}
+	if cert := options.clientCertificate(); cert != nil {
+		// Asked for on every handshake, so new connections pick up a
+		// rotated certificate; open keep-alive connections keep the old one
+		transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get()
+		}
+	}
+	if tlsWarn {
+		// Verify the certificate ourselves so that problems some clients
+		// tolerate let the handshake through; performCheck reports them.
+		// The handshake only knows the server name for DNS hosts, so the
+		// client shakes hands itself to verify IP hosts against the address
+		// dialed. Through -socks5 or an environment proxy the transport
+		// shakes hands instead, and the host's own address is used.
+		var target string
+		if raw, err := checkURL(spec.Target); err == nil {
+			u, _ := url.Parse(raw)
+			target = u.Hostname()
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true
+		transport.TLSClientConfig.VerifyConnection = verifyConnection(target)
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := transport.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			name, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				name = addr
+			}
+			// Cloned when dialing, so it has the protocols the transport
+			// added for HTTP/2
+			config := transport.TLSClientConfig.Clone()
+			if config.ServerName == "" {
+				config.ServerName = name
+			}
+			config.VerifyConnection = verifyConnection(name)
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
+
+	switch {
+	case options.Proxy != nil:
+		// The dialer tunnels through the host's own proxy, so neither
+		// -socks5 nor the environment's proxy may be put in front of it
+		transport.Proxy = nil
+	case socks5Proxy != nil:
+		// Host names are resolved by the proxy, so names only known inside
+		// the tunnelled network work too
+		transport.Proxy = http.ProxyURL(socks5Proxy)
+	}
+
+	// performCheck bounds the whole check with a context, so the client
+	// has no Timeout of its own; each step may have a shorter one
+	client := &http.Client{
+		Transport: &stepTransport{base: transport, step: "request"},
+	}
+	if options.SNI != "" {
+		client.Transport = &hostHeaderTransport{base: client.Transport, host: options.SNI}
+	}
+	if options.LoginURL != "" {
+		client.Transport = &authTransport{
+			base: client.Transport,
+			auth: &sessionAuth{loginURL: options.LoginURL, body: options.LoginBody, base: transport},
+		}
+	}
+	if !followRedirects || expectRedirect != "" {
+		// Hand the 3xx response back to the caller instead of following it
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// clientCertificate is a client certificate for mutual TLS, reloaded from
+// its files whenever they change so certificates can be rotated without a
+// restart.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Newest modification time of the files when last loaded
+}
+
+// clientCertError reports a client certificate that can't be loaded,
+// classified as ReasonTLS.
+type clientCertError struct {
+	err error
+}
+
+func (e *clientCertError) Error() string { return "client certificate: " + e.err.Error() }
+func (e *clientCertError) Unwrap() error { return e.err }
+
+// clientCerts shares one clientCertificate between the hosts using the same
+// files, protected by clientCertsMu.
+var (
+	clientCertsMu sync.Mutex
+	clientCerts   = make(map[[2]string]*clientCertificate)
+)
+
+// clientCertificate returns the host's client certificate: its own cert and
+// key options, else -client-cert and -client-key. It is nil when neither is
+// set.
+func (o hostOptions) clientCertificate() *clientCertificate {
+	certFile, keyFile := o.ClientCert, o.ClientKey
+	if certFile == "" {
+		certFile, keyFile = clientCertFile, clientKeyFile
+	}
+	if certFile == "" {
+		return nil
+	}
+	clientCertsMu.Lock()
+	defer clientCertsMu.Unlock()
+	key := [2]string{certFile, keyFile}
+	if clientCerts[key] == nil {
+		clientCerts[key] = &clientCertificate{certFile: certFile, keyFile: keyFile}
+	}
+	return clientCerts[key]
+}
+
+// get returns the certificate, loading it again if its files have changed.
+// When a changed pair can't be loaded, e.g. halfway through a rotation, the
+// previous certificate stays in use.
+func (c *clientCertificate) get() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var modTime time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if c.cert != nil {
+				return c.cert, nil
+			}
+			return nil, &clientCertError{err}
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert == nil {
+			return nil, &clientCertError{err}
+		}
+		log.Printf("Could not reload client certificate %s, keeping the previous one: %v", c.certFile, err)
+	} else {
+		if c.cert != nil {
+			log.Printf("Reloaded client certificate %s", c.certFile)
+		}
+		c.cert = &cert
+	}
+	c.modTime = modTime
+	return c.cert, nil
+}
+
+// verifyPeer verifies a server's certificate chain for name the way
+// crypto/tls does, except that problems some clients work around are
+// returned as a warning instead of an error:
+//   - a missing intermediate certificate that the leaf's Authority
+//     Information Access URL supplies, as browsers fetch it
+//   - a certificate without SANs that names the host only in its Common
+//     Name, which Go no longer accepts but older clients do
+//
+// An empty name skips the hostname check.
+func verifyPeer(certs []*x509.Certificate, name string) (warning string, err error) {
+	if len(certs) == 0 {
+		return "", errors.New("tls: server sent no certificates")
+	}
+	leaf := certs[0]
+	opts := x509.VerifyOptions{DNSName: name, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, verifyErr := leaf.Verify(opts)
+	if verifyErr == nil {
+		return "", nil
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.As(verifyErr, &unknownAuthority) && len(leaf.IssuingCertificateURL) > 0:
+		if issuer := fetchIssuer(leaf.IssuingCertificateURL[0]); issuer != nil {
+			opts.Intermediates.AddCert(issuer)
+			if _, err := leaf.Verify(opts); err == nil {
+				return fmt.Sprintf("server does not send intermediate certificate %q", issuer.Subject.CommonName), nil
+			}
+		}
+	case errors.As(verifyErr, &hostnameErr) && len(leaf.DNSNames) == 0 && len(leaf.IPAddresses) == 0 &&
+		strings.EqualFold(leaf.Subject.CommonName, name):
+		opts.DNSName = ""
+		if _, err := leaf.Verify(opts); err == nil {
+			return fmt.Sprintf("certificate names %s only in its legacy Common Name field", name), nil
+		}
+	}
+	return "", &tls.CertificateVerificationError{UnverifiedCertificates: certs, Err: verifyErr}
+}
+
+// verifyConnection verifies a handshake's certificate for -tls-warn against
+// the server name sent or, for IP hosts, which send none, against host.
+func verifyConnection(host string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		name := cs.ServerName
+		if name == "" {
+			name = host
+		}
+		_, err := verifyPeer(cs.PeerCertificates, name)
+		return err
+	}
+}
+
+// issuerCache holds intermediate certificates fetched from AIA URLs by
+// fetchIssuer, so a host with a broken chain costs one download.
+var (
+	issuerCacheMu sync.Mutex
+	issuerCache   = make(map[string]*x509.Certificate)
+)
+
+// fetchIssuer downloads the DER certificate at an Authority Information
+// Access URL, returning nil if it can't be fetched or parsed. Failures are
+// cached as well, until the next restart.
+func fetchIssuer(aiaURL string) *x509.Certificate {
+	issuerCacheMu.Lock()
+	defer issuerCacheMu.Unlock()
+	if cert, ok := issuerCache[aiaURL]; ok {
+		return cert
+	}
+
+	var cert *x509.Certificate
+	client := &http.Client{Timeout: checkTimeout()}
+	resp, err := client.Get(aiaURL)
+	if err == nil {
+		defer resp.Body.Close()
+		var der []byte
+		if der, err = io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes)); err == nil {
+			cert, err = x509.ParseCertificate(der)
+		}
+	}
+	if err != nil {
+		log.Printf("Could not fetch intermediate certificate from %s: %v", aiaURL, err)
+	}
+	issuerCache[aiaURL] = cert
+	return cert
+}
+
+// startStep derives the context for one step of a check from the check's
+// overall context, limited to -step-timeout when that is set.
+func startStep(parent context.Context) (context.Context, context.CancelFunc) {
+	if stepTimeoutMs <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(stepTimeoutMs)*time.Millisecond)
+}
+
+// stepError reports a check step that ran out of time, naming the step and
+// whether its own timeout or the check's overall deadline was hit.
+type stepError struct {
+	step    string
+	overall bool
+}
+
+func (e *stepError) Error() string {
+	if e.overall {
+		return fmt.Sprintf("check deadline of %v exceeded during %s step", checkTimeout(), e.step)
+	}
+	return fmt.Sprintf("%s step timed out after %dms", e.step, stepTimeoutMs)
+}
+
+func (e *stepError) Unwrap() error { return context.DeadlineExceeded }
+
+// stepFailure returns err, or a stepError if it was caused by the step's
+// context running out.
+func stepFailure(step string, parent, ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return &stepError{step: step, overall: parent.Err() == context.DeadlineExceeded}
+}
+
+// hostHeaderTransport sends every request with the given Host header, so
+// the server picks the same virtual host as the TLS server name. Redirects
+// are followed with the same name, as with the TLS configuration.
+type hostHeaderTransport struct {
+	base http.RoundTripper
+	host string
+}
+
+func (t *hostHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Host = t.host
+	return t.base.RoundTrip(req)
+}
+
+// stepTransport runs each request as a named step with its own timeout.
+// The step lasts until the response body is closed.
+type stepTransport struct {
+	base http.RoundTripper
+	step string
+}
+
+func (t *stepTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := startStep(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, stepFailure(t.step, req.Context(), ctx, err)
+	}
+	resp.Body = &stepBody{ReadCloser: resp.Body, cancel: cancel, fail: func(err error) error {
+		return stepFailure(t.step, req.Context(), ctx, err)
+	}}
+	return resp, nil
+}
+
+// stepBody ends its step when closed, and names the step in read errors.
+type stepBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	fail   func(error) error
+}
+
+func (b *stepBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = b.fail(err)
+	}
+	return n, err
+}
+
+func (b *stepBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// authStrategy authorizes a host's check requests, for hosts whose health
+// endpoint needs credentials.
+type authStrategy interface {
+	// apply adds credentials to req, obtaining them first if needed.
+	apply(req *http.Request) error
+	// expired reports whether resp shows the credentials are no longer
+	// accepted, and forgets them so the next apply obtains new ones.
+	expired(req *http.Request, resp *http.Response) bool
+}
+
+// loginError reports a failed login step, classified as ReasonAuth.
+type loginError struct {
+	err error
+}
+
+func (e *loginError) Error() string { return "login failed: " + e.err.Error() }
+func (e *loginError) Unwrap() error { return e.err }
+
+// authTransport applies an authStrategy to every request, and when a
+// response shows the credentials have expired, renews them and retries the
+// request once.
+type authTransport struct {
+	base http.RoundTripper
+	auth authStrategy
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		authed := req.Clone(req.Context())
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			authed.Body = body
+		}
+		if err := t.auth.apply(authed); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(authed)
+		if err != nil || attempt > 0 || !t.auth.expired(authed, resp) {
+			return resp, err
+		}
+		resp.Body.Close()
+		if req.Body != nil && req.GetBody == nil {
+			return nil, errors.New("session expired and the request body cannot be resent")
+		}
+	}
+}
+
+// sessionAuth is the authStrategy of hosts with a login option: it POSTs
+// the login body to the login URL and sends the cookies it sets with each
+// check. The session is considered expired on a 401 or a redirect back to
+// the login URL.
+type sessionAuth struct {
+	loginURL string
+	body     string // $VARS are expanded from the environment at login
+	base     http.RoundTripper
+
+	mu      sync.Mutex
+	cookies []*http.Cookie
+}
+
+func (a *sessionAuth) apply(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cookies == nil {
+		cookies, err := a.login(req.Context())
+		if err != nil {
+			return &loginError{err}
+		}
+		a.cookies = cookies
+	}
+	for _, cookie := range a.cookies {
+		req.AddCookie(cookie)
+	}
+	return nil
+}
+
+func (a *sessionAuth) expired(req *http.Request, resp *http.Response) bool {
+	isExpired := resp.StatusCode == http.StatusUnauthorized
+	if location, err := resp.Location(); err == nil && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if login, err := req.URL.Parse(a.loginURL); err == nil {
+			isExpired = location.Host == login.Host && location.Path == login.Path
+		}
+	}
+	if isExpired {
+		log.Printf("Session for %s expired (status %d), logging in again", req.URL.Host, resp.StatusCode)
+		a.mu.Lock()
+		a.cookies = nil
+		a.mu.Unlock()
+	}
+	return isExpired
+}
+
+// login posts the login body and returns the session cookies it sets. The
+// body is sent as JSON if it looks like JSON, else as a form. Logging in is
+// a step of its own, with its own -step-timeout.
+func (a *sessionAuth) login(parent context.Context) (cookies []*http.Cookie, err error) {
+	ctx, cancel := startStep(parent)
+	defer cancel()
+	defer func() { err = stepFailure("login", parent, ctx, err) }()
+
+	body := os.ExpandEnv(a.body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.loginURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if strings.HasPrefix(strings.TrimSpace(body), "{") {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// A redirect after login is expected; its response carries the cookies
+	resp, err := a.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodyBytes))
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s answered status %d", a.loginURL, resp.StatusCode)
+	}
+	cookies = resp.Cookies()
+	if len(cookies) == 0 {
+		return nil, fmt.Errorf("%s set no cookies", a.loginURL)
+	}
+	return cookies, nil
+}
+
+// checkResolver looks up the host names of checks: the system resolver, or
+// the -resolver DNS server.
+var checkResolver = net.DefaultResolver
+
+// newResolver returns a resolver that sends every query to the DNS server
+// at addr (IP[:port], port 53 by default), whatever /etc/resolv.conf says.
+func newResolver(addr string) (*net.Resolver, error) {
+	server, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		ip, ipErr := netip.ParseAddr(strings.Trim(addr, "[]"))
+		if ipErr != nil {
+			return nil, fmt.Errorf("%q must be an IP address, optionally with a port", addr)
+		}
+		server = netip.AddrPortFrom(ip, 53)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.String())
+		},
+	}, nil
+}
+
+// socks5Proxy is parsed from -socks5; nil when checks connect directly.
+var socks5Proxy *url.URL
+
+// parseSOCKS5 turns a -socks5 value into a proxy URL. The net/http
+// transport speaks SOCKS5 itself, including username/password auth.
+func parseSOCKS5(spec string) (*url.URL, error) {
+	u, err := url.Parse("socks5://" + strings.TrimPrefix(spec, "socks5://"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("%q must be host:port", spec)
+	}
+	return u, nil
+}
+
+// parseConnectProxy turns the value of a proxy option, [http://][user:password@]host:port,
+// into a proxy URL.
+func parseConnectProxy(spec string) (*url.URL, error) {
+	u, err := url.Parse("http://" + strings.TrimPrefix(spec, "http://"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" || u.Port() == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("%q must be host:port", spec)
+	}
+	return u, nil
+}
+
+// dialConnect connects to addr through an HTTP CONNECT tunnel opened by
+// proxy. Unlike the transport's own proxy support, which forwards plain HTTP
+// requests to the proxy as they are, every connection is tunnelled, so
+// gateways that only allow CONNECT work for http:// hosts too. The name in
+// addr is resolved by the proxy.
+func dialConnect(ctx context.Context, dialer *net.Dialer, network string, proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxy.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		// The far end spoke first and the proxy's reply was read with it
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection some of whose input has already been read
+// into reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// checkURL turns a host spec into the URL to request. A bare host (with or
+// without a path and query string) defaults to http://; everything after the
+// host is preserved as given.
+func checkURL(host string) (string, error) {
+	target := host
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		target = "http://" + host // Default to HTTP for simplicity
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host in %q", host)
+	}
+	return u.String(), nil
+}
+
+// displayName derives a short label for a host spec: for URLs, the host and
+// path without the scheme, trailing slash, or query string. Other specs
+// (e.g. exec commands) are shown as given.
+func displayName(host string) string {
+	if checkType != "http" {
+		return host
+	}
+	target, err := checkURL(host)
+	if err != nil {
+		return host
+	}
+	u, _ := url.Parse(target)
+	name := u.Host + strings.TrimSuffix(u.Path, "/")
+	if u.RawQuery != "" {
+		name += "?…"
+	}
+	return name
+}
+
+// checkTimeout returns the -timeout flag as a duration.
+func checkTimeout() time.Duration {
+	return time.Duration(timeoutMs) * time.Millisecond
+}
+
+// performCheck runs one check against host, with the host's options, and
+// reports the result, including the traffic it caused.
+func performCheck(client *http.Client, host string, options hostOptions) checkResult {
+	source := options.source()
+	meter := &trafficMeter{}
+	var result checkResult
+	switch checkType {
+	case "exec":
+		result = performExecCheck(host)
+	case "tcp":
+		result = performTCPCheck(host, source, meter)
+	case "udp":
+		result = performUDPCheck(host, source, meter)
+	case "icmp":
+		result = performICMPCheck(host, source, options.pingSize(), meter)
+	default:
+		result = performHTTPCheck(client, host, meter)
+	}
+	result.Requests = meter.requests.Load()
+	result.BytesSent = meter.sent.Load()
+	result.BytesReceived = meter.received.Load()
+	return result
+}
+
+// trafficMeter counts the traffic of one check. The counters are atomic as
+// HTTP connections are read by the transport's own goroutines.
+type trafficMeter struct {
+	requests, sent, received atomic.Int64
+}
+
+// trafficMeterKey is the context key under which an HTTP check passes its
+// trafficMeter to the connections it dials.
+type trafficMeterKey struct{}
+
+// trace returns a context whose HTTP requests are counted by m, along with
+// the traffic of the connections they use. A kept-alive connection is
+// counted by whichever check used it last.
+func (m *trafficMeter) trace(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, trafficMeterKey{}, m)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			m.requests.Add(1)
+			conn := info.Conn
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				conn = tlsConn.NetConn()
+			}
+			if counted, ok := conn.(*countingConn); ok {
+				counted.meter.Store(m)
+			}
+		},
+	})
+}
+
+// count wraps a connection a tcp or udp check has opened, counting it as a
+// request and its traffic in m.
+func (m *trafficMeter) count(conn net.Conn) net.Conn {
+	m.requests.Add(1)
+	counted := &countingConn{Conn: conn}
+	counted.meter.Store(m)
+	return counted
+}
+
+// countingConn adds the bytes read from and written to a connection to the
+// traffic meter it is currently assigned to, if any. Protocol overheads
+// below TCP and UDP are not seen.
+type countingConn struct {
+	net.Conn
+	meter atomic.Pointer[trafficMeter]
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if m := c.meter.Load(); m != nil {
+		m.received.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if m := c.meter.Load(); m != nil {
+		m.sent.Add(int64(n))
+	}
+	return n, err
+}
+
+// performHTTPCheck requests host's URL, counting the traffic in meter.
+func performHTTPCheck(client *http.Client, host string, meter *trafficMeter) checkResult {
+	target, err := checkURL(host)
+	if err != nil {
+		log.Printf("Invalid URL for %s: %v", host, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: ReasonInvalid}
+	}
+
+	startTime := time.Now()
+
+	// -timeout bounds the whole check, whatever steps it takes, so checks
+	// can't hang indefinitely
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout())
+	defer cancel()
+	ctx = meter.trace(ctx)
+
+	// HEAD is the default as it only requests headers; GET is needed to inspect
+	// the body, and POST for endpoints that only answer to a payload
+	var body io.Reader
+	if checkBody != nil {
+		body = bytes.NewReader(checkBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, checkMethod, target, body)
+	if err != nil {
+		log.Printf("Error creating request for %s: %v", host, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: ReasonInvalid}
+	}
+	if checkBody != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if !disableCompression && req.Method != http.MethodHead {
+		// As the transport would, had we not turned that off
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	var traceID string
+	if sendTraceparent {
+		var spanID string
+		traceID, spanID = newTraceIDs()
+		req.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Connection refused, timeout, or DNS error
+		log.Printf("Host %s DOWN (Error: %v)", host, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+	}
+	defer resp.Body.Close()
+
+	// Calculate actual latency
+	result := checkResult{
+		Status:    "UP",
+		LatencyMs: float64(time.Since(startTime).Microseconds()) / 1000.0, // Convert to milliseconds
+		TraceID:   traceID,
+		Proto:     resp.Proto,
+	}
+	if resp.TLS != nil {
+		result.TLSVersion = tls.VersionName(resp.TLS.Version)
+		result.TLSCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+	// Each request made to follow a redirect links back to the response
+	// that caused it
+	for r := resp.Request; r.Response != nil; r = r.Response.Request {
+		result.Redirects++
+	}
+	var tlsWarning string
+	if tlsWarn && resp.TLS != nil {
+		// Repeat the verification, which the handshake let through, to
+		// find the warning; IP hosts send no server name, so use the URL's host
+		name := resp.TLS.ServerName
+		if name == "" {
+			name = resp.Request.URL.Hostname()
+		}
+		tlsWarning, err = verifyPeer(resp.TLS.PeerCertificates, name)
+		if err != nil {
+			log.Printf("Host %s DOWN (Error: %v)", host, err)
+			return checkResult{Status: "DOWN", LatencyMs: result.LatencyMs, Err: err.Error(), Reason: ReasonTLS}
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		// The host is rate limiting us rather than failing, so back off as asked
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			result.Status = "THROTTLED"
+			result.RetryAfter = min(delay, maxRetryAfter)
+			result.Err = fmt.Sprintf("status %d, retry after %v", resp.StatusCode, result.RetryAfter)
+			result.Reason = ReasonThrottled
+			log.Printf("Host %s THROTTLED (%s)", host, result.Err)
+			return result
+		}
+	}
+
+	isRedirect := resp.StatusCode >= 300 && resp.StatusCode < 400
+	switch {
+	case expectRedirect != "":
+		// The response must be a redirect pointing where we expect it to
+		if msg := checkRedirectTarget(resp); msg != "" {
+			result.Status = "DOWN"
+			result.Err = msg
+			result.Reason = ReasonRedirect
+		}
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		// A 2xx status code is generally considered UP
+	case isRedirect && !followRedirects:
+		// Redirects are not followed, so the 3xx itself is the healthy answer
+	default:
+		result.Status = "DOWN" // Treat non-2xx as a service failure
+		result.Err = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		result.Reason = ReasonHTTPStatus
+	}
+
+	if req.Method != http.MethodHead {
+		wire := &countingReader{r: resp.Body}
+		decoded := &countingReader{r: wire}
+		result.ContentEncoding = resp.Header.Get("Content-Encoding")
+		if strings.EqualFold(result.ContentEncoding, "gzip") {
+			gz, err := gzip.NewReader(wire)
+			if err != nil && result.Status == "UP" {
+				result.Status = "DOWN"
+				result.Err = "invalid gzip response body: " + err.Error()
+				result.Reason = ReasonBody
+			} else if err == nil {
+				decoded.r = gz
+			}
+		}
+
+		if result.Status == "UP" && expectJSONPath != nil {
+			if msg := checkJSONBody(decoded); msg != "" {
+				result.Status = "DOWN"
+				result.Err = msg
+				result.Reason = ReasonBody
+			}
+		}
+		// Read the rest to measure it; a body cut short by the timeout
+		// leaves the sizes unknown
+		if _, err := io.Copy(io.Discard, decoded); err == nil {
+			result.WireBytes = wire.n
+			result.BodyBytes = decoded.n
+		}
+	}
+
+	if result.Status == "UP" && tlsWarning != "" {
+		// The connection works, but the certificate needs attention
+		result.Status = "WARN"
+		result.Err = tlsWarning
+		result.Reason = ReasonTLSWarning
+		log.Printf("Host %s WARN (%s)", host, result.Err)
+	}
+
+	if result.Status == "UP" && maxRedirects > 0 && result.Redirects > maxRedirects {
+		// The host answers, but the chain of redirects to it costs time
+		result.Status = "WARN"
+		result.Err = fmt.Sprintf("%d redirects to reach %s, more than %d", result.Redirects, resp.Request.URL.Redacted(), maxRedirects)
+		result.Reason = ReasonRedirects
+		log.Printf("Host %s WARN (%s)", host, result.Err)
+	}
+
+	if result.Status == "DOWN" {
+		log.Printf("Host %s DOWN (%s)", host, result.Err)
+	}
+	return result
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newTraceIDs returns a random W3C trace ID and parent span ID, hex encoded.
+func newTraceIDs() (traceID, spanID string) {
+	var ids [24]byte
+	cryptorand.Read(ids[:])
+	return hex.EncodeToString(ids[:16]), hex.EncodeToString(ids[16:])
+}
+
+// checkBody is the payload sent by POST checks, read from -body or
+// -body-file; nil for other methods.
+var checkBody []byte
+
+// metricPattern finds the first number in an exec check's output.
+var metricPattern = regexp.MustCompile(`[-+]?[0-9]*\.?[0-9]+([eE][-+]?[0-9]+)?`)
+
+// performExecCheck runs the command named by spec (split on whitespace, no
+// shell) and reports UP when it exits 0. The wall-clock run time is used as
+// the latency.
+func performExecCheck(spec string) checkResult {
+	args := strings.Fields(spec)
+	if len(args) == 0 {
+		return checkResult{Status: "DOWN", Err: "empty command", Reason: ReasonInvalid}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout())
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &limitedBuffer{buf: &stdout, remaining: maxBodyBytes}
+	cmd.Stderr = &limitedBuffer{buf: &stderr, remaining: maxBodyBytes}
+
+	startTime := time.Now()
+	err := cmd.Run()
+	result := checkResult{
+		Status:    "UP",
+		LatencyMs: float64(time.Since(startTime).Microseconds()) / 1000.0,
+	}
+
+	if err != nil {
+		result.Status = "DOWN"
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			result.Err = fmt.Sprintf("command timed out after %v", checkTimeout())
+			result.Reason = ReasonTimeout
+		default:
+			result.Err = err.Error()
+			result.Reason = ReasonExec
+			// Include the first line of output as the most likely explanation
+			output := strings.TrimSpace(stderr.String())
+			if output == "" {
+				output = strings.TrimSpace(stdout.String())
+			}
+			if line, _, _ := strings.Cut(output, "\n"); line != "" {
+				result.Err += ": " + line
+			}
+		}
+		log.Printf("Host %s DOWN (%s)", spec, result.Err)
+	}
+
+	if execMetric {
+		if match := metricPattern.FindString(stdout.String()); match != "" {
+			if value, err := strconv.ParseFloat(match, 64); err == nil {
+				result.Metric = &value
+			}
+		}
+	}
+	return result
+}
+
+// Probe data decoded from -udp-payload, -udp-expect, -tcp-send and
+// -tcp-expect.
+var (
+	udpPayloadBytes []byte
+	udpExpectBytes  []byte
+	tcpSendBytes    []byte
+	tcpExpectBytes  []byte
+)
+
+// parseProbeData decodes a -udp-payload, -udp-expect, -tcp-send or
+// -tcp-expect value: hex after a "hex:" prefix, otherwise the string as
+// given.
+func parseProbeData(value string) ([]byte, error) {
+	if encoded, ok := strings.CutPrefix(value, "hex:"); ok {
+		return hex.DecodeString(strings.ReplaceAll(encoded, " ", ""))
+	}
+	return []byte(value), nil
+}
+
+// performUDPCheck sends -udp-payload to the host:port in spec and reports UP
+// when a reply containing -udp-expect arrives within the timeout. Having no
+// connection to rely on, silence counts as DOWN. A valid source address is
+// used as the local end.
+func performUDPCheck(spec string, source netip.Addr, meter *trafficMeter) checkResult {
+	dialer := &net.Dialer{Timeout: checkTimeout(), Resolver: checkResolver}
+	if source.IsValid() {
+		dialer.LocalAddr = &net.UDPAddr{IP: source.AsSlice()}
+	}
+	startTime := time.Now()
+	conn, err := dialer.Dial("udp", spec)
+	if err != nil {
+		log.Printf("Host %s DOWN (Error: %v)", spec, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+	}
+	conn = meter.count(conn)
+	defer conn.Close()
+	conn.SetDeadline(startTime.Add(checkTimeout()))
+
+	if _, err := conn.Write(udpPayloadBytes); err != nil {
+		log.Printf("Host %s DOWN (Error: %v)", spec, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+	}
+
+	reply := make([]byte, 64*1024) // Largest possible datagram
+	n, err := conn.Read(reply)
+	if err != nil {
+		result := checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+		if result.Reason == ReasonTimeout {
+			result.Err = fmt.Sprintf("no reply within %v", checkTimeout())
+		}
+		log.Printf("Host %s DOWN (%s)", spec, result.Err)
+		return result
+	}
+
+	result := checkResult{
+		Status:    "UP",
+		LatencyMs: float64(time.Since(startTime).Microseconds()) / 1000.0,
+	}
+	if !bytes.Contains(reply[:n], udpExpectBytes) {
+		result.Status = "DOWN"
+		result.Err = fmt.Sprintf("reply of %d bytes does not contain the expected response", n)
+		result.Reason = ReasonBody
+		log.Printf("Host %s DOWN (%s)", spec, result.Err)
+	}
+	return result
+}
+
+// performTCPCheck connects to the host:port in spec. On its own that is the
+// whole check, with the handshake as the latency. With -tcp-send and
+// -tcp-expect it goes on to send a probe and wait for a reply, whose round
+// trip becomes the latency, and with -tcp-hold it then keeps the
+// connection open a while, catching services that accept connections only
+// to drop them. A valid source address is used as the local end.
+func performTCPCheck(spec string, source netip.Addr, meter *trafficMeter) checkResult {
+	dialer := &net.Dialer{Timeout: checkTimeout(), Resolver: checkResolver}
+	if source.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: source.AsSlice()}
+	}
+	startTime := time.Now()
+	conn, err := dialer.Dial("tcp", spec)
+	if err != nil {
+		log.Printf("Host %s DOWN (Error: %v)", spec, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+	}
+	conn = meter.count(conn)
+	defer conn.Close()
+	conn.SetDeadline(startTime.Add(checkTimeout()))
+	latency := time.Since(startTime)
+
+	if len(tcpSendBytes) > 0 || len(tcpExpectBytes) > 0 {
+		probeStart := time.Now()
+		if _, err := conn.Write(tcpSendBytes); err != nil {
+			log.Printf("Host %s DOWN (Error: %v)", spec, err)
+			return checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+		}
+		// Read until the expected reply has arrived, however it is split up
+		var reply []byte
+		buf := make([]byte, 4096)
+		for len(reply) == 0 || !bytes.Contains(reply, tcpExpectBytes) {
+			n, err := conn.Read(buf)
+			reply = append(reply, buf[:n]...)
+			if err == nil && len(reply) <= maxBodyBytes {
+				continue
+			}
+			result := checkResult{Status: "DOWN", Reason: ReasonBody}
+			switch {
+			case err == nil:
+				result.Err = fmt.Sprintf("reply of over %d bytes does not contain the expected response", maxBodyBytes)
+			case errors.Is(err, io.EOF):
+				result.Err = fmt.Sprintf("connection closed by the host after %d bytes of reply", len(reply))
+				result.Reason = ReasonNetwork
+			case len(reply) > 0 && classifyError(err) == ReasonTimeout:
+				result.Err = fmt.Sprintf("reply of %d bytes does not contain the expected response", len(reply))
+			default:
+				result.Err, result.Reason = err.Error(), classifyError(err)
+				if result.Reason == ReasonTimeout {
+					result.Err = fmt.Sprintf("no reply within %v", checkTimeout())
+				}
+			}
+			log.Printf("Host %s DOWN (%s)", spec, result.Err)
+			return result
+		}
+		latency = time.Since(probeStart)
+	}
+
+	if tcpHold > 0 {
+		// Anything the host sends meanwhile is ignored; only the connection
+		// ending early counts
+		conn.SetReadDeadline(time.Now().Add(tcpHold))
+		held := time.Now()
+		buf := make([]byte, 4096)
+		var err error
+		for err == nil {
+			_, err = conn.Read(buf)
+		}
+		if classifyError(err) != ReasonTimeout {
+			result := checkResult{
+				Status: "DOWN",
+				Err:    fmt.Sprintf("connection lost after %v: %v", time.Since(held).Round(time.Millisecond), err),
+				Reason: ReasonNetwork,
+			}
+			if errors.Is(err, io.EOF) {
+				result.Err = fmt.Sprintf("connection closed by the host after %v", time.Since(held).Round(time.Millisecond))
+			}
+			log.Printf("Host %s DOWN (%s)", spec, result.Err)
+			return result
+		}
+	}
+
+	return checkResult{Status: "UP", LatencyMs: float64(latency.Microseconds()) / 1000.0}
+}
+
+// ICMP echo message types, for IPv4 and IPv6.
+const (
+	icmpEchoRequest   = 8
+	icmpEchoReply     = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// The bounds of -ping-size and the ping_size option. The payload always has
+// room for the send time, and the largest fits an IPv4 packet.
+const (
+	minPingSize = 8
+	maxPingSize = 65535 - 20 - 8
+)
+
+// performICMPCheck sends -ping-count echo requests of size payload bytes to
+// the host in spec, one after another, each waiting up to its share of the
+// timeout for a reply. The latency is the mean round trip of the replies,
+// and the share of requests left unanswered is the packet loss, which
+// -warn-loss and -down-loss turn into WARN and DOWN. A valid source address
+// is used as the local end.
+//
+// The requests are never fragmented, so a size that fits some link on the
+// path only after fragmenting fails: with the same host listed at a small
+// and a large size, one UP and the other DOWN points at the path MTU.
+func performICMPCheck(spec string, source netip.Addr, size int, meter *trafficMeter) checkResult {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout())
+	defer cancel()
+	addrs, err := checkResolver.LookupNetIP(ctx, "ip", spec)
+	if err != nil {
+		log.Printf("Host %s DOWN (Error: %v)", spec, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+	}
+	addr := addrs[0].Unmap()
+
+	conn, dst, err := listenICMP(addr, source)
+	if err != nil {
+		log.Printf("Host %s DOWN (Error: %v)", spec, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: ReasonNetwork}
+	}
+	defer conn.Close()
+	if err := setDontFragment(conn, addr.Is6()); err != nil {
+		log.Printf("Host %s DOWN (Error: %v)", spec, err)
+		return checkResult{Status: "DOWN", Err: err.Error(), Reason: ReasonNetwork}
+	}
+
+	// Raw sockets see every echo reply to the machine, so ours are told
+	// apart by ID and sequence number. Ping sockets set the ID themselves
+	// and only receive their own replies.
+	id := uint16(rand.Intn(1 << 16))
+	_, raw := dst.(*net.IPAddr)
+	wait := checkTimeout() / time.Duration(pingCount)
+	var received int
+	var totalRTT time.Duration
+	// Room for the echoed payload and, on raw IPv4 sockets, the IP header
+	reply := make([]byte, max(1500, 8+size+60))
+	for seq := 0; seq < pingCount; seq++ {
+		sent := time.Now()
+		echo := icmpEcho(addr, id, uint16(seq), size)
+		if _, err := conn.WriteTo(echo, dst); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				// The kernel knows the path MTU to be smaller than the ping
+				err = fmt.Errorf("%d-byte ping exceeds the path MTU: %w", size, err)
+			}
+			log.Printf("Host %s DOWN (Error: %v)", spec, err)
+			return checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+		}
+		meter.requests.Add(1)
+		meter.sent.Add(int64(len(echo)))
+		conn.SetReadDeadline(sent.Add(wait))
+		for {
+			n, from, err := conn.ReadFrom(reply)
+			if err != nil {
+				break // Timed out: this one is lost
+			}
+			if isEchoReply(reply[:n], addr, from, uint16(seq)) && (!raw || binary.BigEndian.Uint16(reply[4:]) == id) {
+				meter.received.Add(int64(n))
+				received++
+				totalRTT += time.Since(sent)
+				break
+			}
+		}
+	}
+
+	loss := float64(pingCount-received) * 100 / float64(pingCount)
+	result := checkResult{Status: "UP", PacketLoss: loss}
+	if received > 0 {
+		result.LatencyMs = float64((totalRTT / time.Duration(received)).Microseconds()) / 1000.0
+	}
+	switch {
+	case received == 0:
+		result.Status = "DOWN"
+		result.Err = fmt.Sprintf("no reply to %d pings", pingCount)
+		result.Reason = ReasonTimeout
+	case loss >= downLoss:
+		result.Status = "DOWN"
+		result.Err = fmt.Sprintf("%.1f%% packet loss", loss)
+		result.Reason = ReasonPacketLoss
+	case warnLoss > 0 && loss >= warnLoss:
+		result.Status = "WARN"
+		result.Err = fmt.Sprintf("%.1f%% packet loss", loss)
+		result.Reason = ReasonPacketLoss
+	}
+	if result.Status == "DOWN" {
+		log.Printf("Host %s DOWN (%s)", spec, result.Err)
+	}
+	return result
+}
+
+// listenICMP opens a socket for pinging addr and returns it with the
+// address to send to. It prefers an unprivileged ping socket, where the
+// platform has them, and falls back to a raw socket, which needs root or
+// CAP_NET_RAW (or Administrator on Windows).
+func listenICMP(addr, source netip.Addr) (net.PacketConn, net.Addr, error) {
+	if conn, err := listenPingSocket(addr, source); err == nil {
+		return conn, &net.UDPAddr{IP: addr.AsSlice(), Zone: addr.Zone()}, nil
+	}
+
+	network := "ip4:icmp"
+	if addr.Is6() {
+		network = "ip6:ipv6-icmp"
+	}
+	local := ""
+	if source.IsValid() {
+		local = source.String()
+	}
+	conn, err := net.ListenPacket(network, local)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open ICMP socket (needs root, CAP_NET_RAW or net.ipv4.ping_group_range): %w", err)
+	}
+	return conn, &net.IPAddr{IP: addr.AsSlice(), Zone: addr.Zone()}, nil
+}
+
+// icmpEcho builds an echo request with size payload bytes: the time it was
+// sent, then zeros. The kernel fills in the checksum of ICMPv6 messages;
+// IPv4 ones carry their own.
+func icmpEcho(addr netip.Addr, id, seq uint16, size int) []byte {
+	msg := make([]byte, 8+size)
+	msg[0] = icmpEchoRequest
+	if addr.Is6() {
+		msg[0] = icmpv6EchoRequest
+	}
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint64(msg[8:], uint64(time.Now().UnixNano()))
+	if addr.Is4() {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+	return msg
+}
+
+// icmpChecksum is the Internet checksum (RFC 1071) of msg.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// isEchoReply reports whether msg, read from from, answers echo request
+// seq to addr.
+func isEchoReply(msg []byte, addr netip.Addr, from net.Addr, seq uint16) bool {
+	if len(msg) < 8 || binary.BigEndian.Uint16(msg[6:]) != seq {
+		return false
+	}
+	if msg[0] != icmpEchoReply && msg[0] != icmpv6EchoReply {
+		return false
+	}
+	var ip net.IP
+	switch from := from.(type) {
+	case *net.IPAddr:
+		ip = from.IP
+	case *net.UDPAddr:
+		ip = from.IP
+	}
+	fromAddr, ok := netip.AddrFromSlice(ip)
+	return ok && fromAddr.Unmap() == addr.WithZone("")
+}
+
+// limitedBuffer writes into buf until remaining bytes are used up and then
+// silently discards the rest, so a chatty command can't exhaust memory.
+type limitedBuffer struct {
+	buf       *bytes.Buffer
+	remaining int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if l.remaining > 0 {
+		n := len(p)
+		if n > l.remaining {
+			n = l.remaining
+		}
+		l.buf.Write(p[:n])
+		l.remaining -= n
+	}
+	return len(p), nil
+}
+
+// parseExpectJSON splits an -expect-json assertion of the form
+// "path.to.field=value" into its path segments and expected value. A leading
+// "." on the path is optional.
+func parseExpectJSON(spec string) ([]string, string, error) {
+	path, value, ok := strings.Cut(spec, "=")
+	path = strings.TrimPrefix(strings.TrimSpace(path), ".")
+	if !ok || path == "" {
+		return nil, "", fmt.Errorf("expected path=value, got %q", spec)
+	}
+	return strings.Split(path, "."), value, nil
+}
+
+// checkJSONBody decodes a response body and compares the field at
+// -expect-json's path with the expected value. It returns a description of
+// the mismatch, or "" if the assertion holds.
+func checkJSONBody(body io.Reader) string {
+	decoder := json.NewDecoder(io.LimitReader(body, maxBodyBytes))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Sprintf("response is not valid JSON: %v", err)
+	}
+
+	value := doc
+	for _, segment := range expectJSONPath {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			field, ok := node[segment]
+			if !ok {
+				return fmt.Sprintf("JSON field %q not found", strings.Join(expectJSONPath, "."))
+			}
+			value = field
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return fmt.Sprintf("JSON field %q not found", strings.Join(expectJSONPath, "."))
+			}
+			value = node[index]
+		default:
+			return fmt.Sprintf("JSON field %q not found", strings.Join(expectJSONPath, "."))
+		}
+	}
+
+	if actual := fmt.Sprint(value); actual != expectJSONValue {
+		return fmt.Sprintf("JSON field %q is %q, expected %q", strings.Join(expectJSONPath, "."), actual, expectJSONValue)
+	}
+	return ""
+}
+
+// safeCheck runs performCheck, recovering from any panic so that a bug in
+// the check logic cannot silently kill the host's monitoring goroutine. A
+// panicking check is reported as DOWN so the host doesn't freeze on its
+// last status.
+func safeCheck(client *http.Client, host string, options hostOptions) (result checkResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Check for host %s panicked: %v\n%s", host, r, debug.Stack())
+			result = checkResult{Status: "DOWN", Err: fmt.Sprintf("check panicked: %v", r), Reason: ReasonPanic}
+		}
+	}()
+	return performCheck(client, host, options)
+}
+
+// dialNetworkKey is the context key under which familyTransport passes the
+// network ("tcp4" or "tcp6") the check client's dialer must use.
+type dialNetworkKey struct{}
+
+// familyTransport makes a check client's requests connect over one address
+// family only.
+type familyTransport struct {
+	base    http.RoundTripper
+	network string
+}
+
+func (t *familyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(context.WithValue(req.Context(), dialNetworkKey{}, t.network)))
+}
+
+// performDualStackCheck checks the host in spec over IPv4 and IPv6 at the
+// same time, with -dual-stack. Each family's status is reported in the
+// result; the host is WARN if only one of them works and DOWN if neither
+// does. A host with addresses in only one family, or given as an IP
+// address, is checked over that family alone.
+func performDualStackCheck(client *http.Client, spec string, options hostOptions) checkResult {
+	target, err := checkURL(spec)
+	if err != nil {
+		return safeCheck(client, spec, options)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return safeCheck(client, spec, options)
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		result := safeCheck(client, spec, options)
+		if addr.Unmap().Is4() {
+			result.IPv4Status = result.Status
+		} else {
+			result.IPv6Status = result.Status
+		}
+		return result
+	}
+
+	families := []struct {
+		name, network, lookup string
+		present               bool
+		result                checkResult
+	}{
+		{name: "IPv4", network: "tcp4", lookup: "ip4"},
+		{name: "IPv6", network: "tcp6", lookup: "ip6"},
+	}
+	var wg sync.WaitGroup
+	for i := range families {
+		f := &families[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout())
+			defer cancel()
+			_, err := checkResolver.LookupNetIP(ctx, f.lookup, u.Hostname())
+			var dnsErr *net.DNSError
+			switch {
+			case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+				// No addresses in this family
+			case err != nil:
+				f.present = true
+				f.result = checkResult{Status: "DOWN", Err: err.Error(), Reason: classifyError(err)}
+			default:
+				f.present = true
+				familyClient := *client
+				familyClient.Transport = &familyTransport{base: client.Transport, network: f.network}
+				f.result = safeCheck(&familyClient, spec, options)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v4, v6 := families[0], families[1]
+	switch {
+	case !v4.present && !v6.present:
+		// Neither family resolves; a plain check reports that as usual
+		return safeCheck(client, spec, options)
+	case !v6.present:
+		v4.result.IPv4Status = v4.result.Status
+		return v4.result
+	case !v4.present:
+		v6.result.IPv6Status = v6.result.Status
+		return v6.result
+	}
+
+	// Report the IPv4 check unless only IPv6 works, noting the failed family
+	result, failed := v4.result, v6
+	switch v4Works, v6Works := v4.result.Status != "DOWN", v6.result.Status != "DOWN"; {
+	case v4Works && !v6Works:
+		if result.Status == "UP" {
+			result.Status = "WARN"
+		}
+		result.Err, result.Reason = "IPv6: "+v6.result.Err, v6.result.Reason
+	case !v4Works && v6Works:
+		result, failed = v6.result, v4
+		if result.Status == "UP" {
+			result.Status = "WARN"
+		}
+		result.Err, result.Reason = "IPv4: "+failed.result.Err, failed.result.Reason
+	case !v4Works && !v6Works:
+		result.Err = "IPv4: " + v4.result.Err + "; IPv6: " + v6.result.Err
+	}
+	result.IPv4Status, result.IPv6Status = v4.result.Status, v6.result.Status
+	result.Requests = v4.result.Requests + v6.result.Requests
+	result.BytesSent = v4.result.BytesSent + v6.result.BytesSent
+	result.BytesReceived = v4.result.BytesReceived + v6.result.BytesReceived
+	if result.Status == "WARN" {
+		log.Printf("Host %s WARN (%s)", spec, result.Err)
+	}
+	return result
+}
+
+// parseRetryAfter reads a Retry-After header, given either as a number of
+// seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return max(when.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// checkRedirectTarget verifies resp is a redirect whose Location matches
+// -expect-redirect. It returns a description of the problem, or "" if the
+// redirect is as expected.
+func checkRedirectTarget(resp *http.Response) string {
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return fmt.Sprintf("expected a redirect, got status %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return fmt.Sprintf("redirect (%d) has no Location header", resp.StatusCode)
+	}
+
+	// Compare both the raw header and the Location resolved against the request URL
+	candidates := []string{location}
+	if resolved, err := resp.Location(); err == nil {
+		candidates = append(candidates, resolved.String())
+	}
+	for _, candidate := range candidates {
+		if expectRedirectRe != nil {
+			if expectRedirectRe.MatchString(candidate) {
+				return ""
+			}
+		} else if candidate == expectRedirect {
+			return ""
+		}
+	}
+	return fmt.Sprintf("redirect to %q, expected %q", location, expectRedirect)
+}
+
+// nextCheckDelay returns the wait before a host's next check: the interval
+// itself, or with -jitter-percent a uniformly random value within that
+// percentage either side of it, so the average interval is unchanged.
+func nextCheckDelay(interval time.Duration) time.Duration {
+	if jitterPercent <= 0 {
+		return interval
+	}
+	offset := (rand.Float64()*2 - 1) * jitterPercent / 100
+	return time.Duration(float64(interval) * (1 + offset))
+}
+
+// registerHost adds a host to the status map in the PENDING state, carrying
+// over any stats restored from -state-file.
+func registerHost(spec hostSpec, interval time.Duration) {
+	host := spec.Host
+	mu.Lock()
+	hostConfigs[host] = spec
+	status := HostStatus{
+		Host:        host,
+		SLOMs:       spec.Options.SLOMs,
+		SLOTarget:   spec.Options.sloTarget(),
+		DisplayName: spec.Options.Name,
+		Region:      region,
+		Group:       spec.Options.Group,
+		IntervalMs:  int(interval / time.Millisecond),
+		Schedule:    spec.Options.Schedule.String(),
+		ExpectedUp:  spec.Options.ExpectedUp.String(),
+		Status:      "PENDING",
+		LatencyMs:   0,
+		PacketLoss:  0,
+		// LastCheck defaults to zero time (0001-01-01T00:00:00Z)
+	}
+	if spec.Options.Schedule != nil {
+		status.IntervalMs = 0
+	}
+	status.Critical = spec.Options.Critical
+	if spec.Options.Weight != 0 {
+		weight := spec.Options.Weight
+		status.Weight = &weight
+	}
+	if status.DisplayName == "" {
+		status.DisplayName = displayName(spec.Target)
+		if spec.Options.SourceIP.IsValid() {
+			status.DisplayName += " via " + spec.Options.SourceIP.String()
+		}
+		if spec.Options.PingSize > 0 {
+			status.DisplayName += fmt.Sprintf(" (%d bytes)", spec.Options.PingSize)
+		}
+	}
+	if checkType == "icmp" {
+		status.PingSize = spec.Options.pingSize()
+	}
+	// Stats restored from -state-file carry over; otherwise start fresh
+	if stats, ok := hostStatsMap[host]; ok {
+		status.CheckCount = int(stats.TotalChecks)
+		status.LastSuccess = stats.LastSuccess
+		status.EverUp = stats.UpChecks > 0
+		status.UptimePercent = stats.uptimePercent()
+		status.MTBF, status.MTTR = stats.reliability()
+	} else {
+		hostStatsMap[host] = &hostStats{}
+	}
+	hostStatuses[host] = status
+	mu.Unlock()
+	bumpVersion()
+
+	log.Printf("Starting monitoring for host: %s at %v intervals", host, interval)
+}
+
+// hostControl steers a running per-host monitor goroutine. Requests are
+// sent on its channels and handled between checks, so they never race with
+// one in progress.
+type hostControl struct {
+	trigger  chan chan HostStatus // Runs a check now; the status is sent back once recorded
+	interval chan time.Duration   // Replaces the check interval
+	ctx      context.Context      // Done once the monitor has been told to stop
+	cancel   context.CancelFunc   // Stops the monitor
+}
+
+// hostControls holds the control of every per-host monitor goroutine,
+// protected by mu. Hosts checked by checkScheduler have none; the scheduler
+// offers the same operations as methods.
+var hostControls = make(map[string]*hostControl)
+
+// monitorHost periodically checks a host and updates the global status map
+// until ctx is cancelled or the host's control stops it.
+func monitorHost(ctx context.Context, spec hostSpec, interval time.Duration) {
+	registerHost(spec, interval)
+	host := spec.Host
+	client := newCheckClient(spec)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	control := &hostControl{
+		trigger:  make(chan chan HostStatus),
+		interval: make(chan time.Duration),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	mu.Lock()
+	hostControls[host] = control
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		// The host may have been stopped and started again meanwhile
+		if hostControls[host] == control {
+			delete(hostControls, host)
+		}
+		mu.Unlock()
+	}()
+
+	// A fresh timer each cycle (rather than a ticker) lets jitter vary every
+	// wait. Each deadline is computed from the previous one, not from when the
+	// check finished, so check duration doesn't stretch the interval.
+	schedule := spec.Options.Schedule
+	nextCheck := firstDeadline(schedule, interval)
+	timer := time.NewTimer(time.Until(nextCheck))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			backoff := runCheck(client, host)
+
+			nextCheck = postpone(nextDeadline(schedule, nextCheck, interval), backoff)
+			timer.Reset(time.Until(nextCheck))
+
+		case reply := <-control.trigger:
+			// An extra check; the regular schedule is unaffected unless the
+			// host asks us to back off
+			if backoff := runCheck(client, host); backoff > 0 {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				nextCheck = postpone(nextCheck, backoff)
+				timer.Reset(time.Until(nextCheck))
+			}
+			status, _ := localStatus(host)
+			reply <- status
+
+		case interval = <-control.interval:
+			// Start the new schedule from now rather than waiting out the old interval
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			nextCheck = time.Now().Add(nextCheckDelay(interval))
+			timer.Reset(time.Until(nextCheck))
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// startMonitor starts checking a host, on the scheduler when there is one.
+func startMonitor(ctx context.Context, spec hostSpec, interval time.Duration) {
+	if checkScheduler != nil {
+		checkScheduler.add(spec, interval)
+	} else {
+		go monitorHost(ctx, spec, interval)
+	}
+}
+
+// stopMonitor stops checking a host and forgets its status. A check already
+// in progress finishes, but its result is dropped.
+func stopMonitor(host string) {
+	if checkScheduler != nil {
+		checkScheduler.remove(host)
+	} else if control, err := lookupControl(host); err == nil {
+		control.cancel()
+	}
+
+	mu.Lock()
+	delete(hostConfigs, host)
+	delete(hostStatuses, host)
+	delete(hostStatsMap, host)
+	delete(hostControls, host)
+	mu.Unlock()
+	bumpVersion()
+	log.Printf("Stopped monitoring host: %s", host)
+}
+
+// errUnknownHost is returned for operations on a host that is not monitored
+// by this instance.
+var errUnknownHost = errors.New("unknown host")
+
+// lookupControl returns the control of host's monitor goroutine.
+func lookupControl(host string) (*hostControl, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	control, ok := hostControls[host]
+	if !ok {
+		return nil, errUnknownHost
+	}
+	return control, nil
+}
+
+// triggerCheck asks host's monitor to check it immediately and waits for
+// the fresh status.
+func triggerCheck(ctx context.Context, host string) (HostStatus, error) {
+	reply := make(chan HostStatus, 1) // Buffered so the monitor never blocks on an abandoned request
+	if checkScheduler != nil {
+		if !checkScheduler.trigger(host, reply) {
+			return HostStatus{}, errUnknownHost
+		}
+	} else {
+		control, err := lookupControl(host)
+		if err != nil {
+			return HostStatus{}, err
+		}
+		select {
+		case control.trigger <- reply:
+		case <-control.ctx.Done():
+			return HostStatus{}, errUnknownHost
+		case <-ctx.Done():
+			return HostStatus{}, ctx.Err()
+		}
+	}
+
+	select {
+	case status := <-reply:
+		return status, nil
+	case <-ctx.Done():
+		return HostStatus{}, ctx.Err()
+	}
+}
+
+// setCheckInterval changes how often host is checked, starting the new
+// schedule from now.
+func setCheckInterval(host string, interval time.Duration) error {
+	if checkScheduler != nil {
+		if !checkScheduler.setInterval(host, interval) {
+			return errUnknownHost
+		}
+		return nil
+	}
+	control, err := lookupControl(host)
+	if err != nil {
+		return err
+	}
+	select {
+	case control.interval <- interval:
+		return nil
+	case <-control.ctx.Done():
+		return errUnknownHost
+	}
+}
+
+// runCheck performs one rate-limited check of host and records the result.
+// It returns how long the host asked us to wait before checking again, or 0.
+func runCheck(client *http.Client, host string) time.Duration {
+	if checkLimiter != nil {
+		if delay := checkLimiter.wait(); delay > 0 {
+			log.Printf("Rate limit: check for %s throttled by %v", host, delay.Round(time.Millisecond))
+		}
+	}
+
+	mu.RLock()
+	spec, ok := hostConfigs[host]
+	mu.RUnlock()
+	if !ok {
+		spec = hostSpec{Host: host, Target: host}
+	}
+
+	var result checkResult
+	if dualStack {
+		result = performDualStackCheck(client, spec.Target, spec.Options)
+	} else {
+		result = safeCheck(client, spec.Target, spec.Options)
+	}
+	result = spec.Options.checkProto(host, result)
+	if result.Status == "DOWN" && warnReasons[result.Reason] {
+		result.Status = "WARN"
+	}
+	recordResult(host, result)
+	return result.RetryAfter
+}
+
+// postpone returns next, or the time backoff from now if that is later.
+func postpone(next time.Time, backoff time.Duration) time.Time {
+	if backoff <= 0 {
+		return next
+	}
+	if earliest := time.Now().Add(backoff); earliest.After(next) {
+		return earliest
+	}
+	return next
+}
+
+// advanceDeadline returns the deadline for the check after the one due at
+// previous.
+func advanceDeadline(previous time.Time, interval time.Duration) time.Time {
+	next := previous.Add(nextCheckDelay(interval))
+	if now := time.Now(); next.Before(now) {
+		// The check overran its slot; don't try to catch up with a burst
+		next = now
+	}
+	return next
+}
+
+// firstDeadline returns when a host's first check is due: its schedule's
+// next run, or one interval from now.
+func firstDeadline(schedule *cronSchedule, interval time.Duration) time.Time {
+	if schedule != nil {
+		return schedule.next(time.Now())
+	}
+	return time.Now().Add(nextCheckDelay(interval))
+}
+
+// nextDeadline returns when a host's check after the one due at previous is
+// due: its schedule's next run, or advanceDeadline's.
+func nextDeadline(schedule *cronSchedule, previous time.Time, interval time.Duration) time.Time {
+	if schedule != nil {
+		return schedule.next(time.Now())
+	}
+	return advanceDeadline(previous, interval)
+}
+
+// cronSchedule is a standard five-field cron expression (minute, hour, day
+// of month, month, day of week) that a host is checked on instead of a
+// fixed interval, e.g. "*/5 9-16 * * 1-5" for every five minutes during
+// weekday office hours.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // Bit n set when value n matches
+	domAny, dowAny                bool   // The field was *, so only the other day field counts
+	loc                           *time.Location
+	spec                          string
+}
+
+// cronDescriptors are the @ shorthands for common schedules.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Names allowed in the month and day of week fields.
+var (
+	cronMonths = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	cronDays = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+// parseCron parses a cron expression, optionally prefixed with
+// CRON_TZ=Zone and a space (default local time). Each field takes *,
+// values, ranges (a-b), steps (*/n, a-b/n) and comma-separated lists of
+// these; months and weekdays may be given by name. A day of week of 7 is
+// Sunday, like 0.
+func parseCron(spec string) (*cronSchedule, error) {
+	c := &cronSchedule{loc: time.Local, spec: spec}
+	expr := strings.TrimSpace(spec)
+	if zone, ok := strings.CutPrefix(expr, "CRON_TZ="); ok {
+		zone, expr, _ = strings.Cut(zone, " ")
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", zone)
+		}
+		c.loc = loc
+	}
+	if descriptor, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		expr = descriptor
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q must have five fields: minute hour day-of-month month day-of-week", spec)
+	}
+	for i, field := range []struct {
+		dst      *uint64
+		min, max int
+		names    map[string]int
+	}{{&c.minute, 0, 59, nil}, {&c.hour, 0, 23, nil}, {&c.dom, 1, 31, nil}, {&c.month, 1, 12, cronMonths}, {&c.dow, 0, 7, cronDays}} {
+		bits, err := parseCronField(fields[i], field.min, field.max, field.names)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", spec, err)
+		}
+		*field.dst = bits
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never runs", spec)
+	}
+	return c, nil
+}
+
+// parseCronField returns the values a cron field matches as a bit set.
+// names, if any, may be used in place of numbers.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		span, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if span != "*" {
+			from, to, isRange := strings.Cut(span, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max // "a/n" runs from a to the end of the range
+			}
+			if hi == 0 && max == 7 && lo > 0 {
+				hi = 7 // A weekday range may end on Sunday, e.g. MON-SUN
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("range %q runs backwards", span)
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+// dayMatches reports whether the schedule runs on t's day. As in cron, when
+// both day fields are restricted a day matching either one counts.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if !c.domAny && !c.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first minute after t that the schedule runs at, or the
+// zero time if it doesn't run in the next five years.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var u time.Time
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			u = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			u = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			u = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minute&(1<<t.Minute()) == 0:
+			u = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, c.loc)
+		default:
+			return t
+		}
+		// A wall clock time that a DST change skips or repeats can come out
+		// no later than t, so move on an hour at a time until it is
+		for !u.After(t) {
+			u = u.Add(time.Hour)
+		}
+		t = u
+	}
+	return time.Time{}
+}
+
+// active reports whether t falls in an hour the schedule runs in; outside
+// those hours the host is shown as not scheduled.
+func (c *cronSchedule) active(t time.Time) bool {
+	t = t.In(c.loc)
+	return c.month&(1<<int(t.Month())) != 0 && c.dayMatches(t) && c.hour&(1<<t.Hour()) != 0
+}
+
+// String returns the expression the schedule was parsed from.
+func (c *cronSchedule) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.spec
+}
+
+// checkScheduler runs checks on a fixed pool of workers when -workers is
+// set; it is nil when each host has its own goroutine.
+var checkScheduler *scheduler
+
+// scheduledCheck is a host waiting in the scheduler's queue.
+type scheduledCheck struct {
+	host     string
+	interval time.Duration
+	schedule *cronSchedule // Replaces interval when set
+	client   *http.Client
+	due      time.Time
+	index    int // Position in the heap, maintained by checkQueue; -1 while running
+
+	// replies wait for the host's next check to start; running holds those
+	// waiting for the check in progress. Both are protected by scheduler.mu,
+	// as is removed, which keeps a running check from being requeued.
+	replies []chan HostStatus
+	running []chan HostStatus
+	removed bool
+}
+
+// checkQueue is a min-heap of scheduled checks ordered by due time.
+type checkQueue []*scheduledCheck
+
+func (q checkQueue) Len() int           { return len(q) }
+func (q checkQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q checkQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *checkQueue) Push(x interface{}) {
+	c := x.(*scheduledCheck)
+	c.index = len(*q)
+	*q = append(*q, c)
+}
+
+func (q *checkQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	c.index = -1
+	return c
+}
+
+// scheduler hands due checks from a time-ordered queue to a fixed number of
+// workers, so thousands of mostly idle hosts don't each need a goroutine.
+type scheduler struct {
+	mu     sync.Mutex
+	queue  checkQueue
+	checks map[string]*scheduledCheck // Every host, queued or running
+	wake   chan struct{}              // Signals the dispatcher that the queue head may have changed
+	jobs   chan *scheduledCheck
+}
+
+// newScheduler starts a dispatcher and the given number of workers. They
+// stop once ctx is cancelled.
+func newScheduler(ctx context.Context, workers int) *scheduler {
+	s := &scheduler{
+		checks: make(map[string]*scheduledCheck),
+		wake:   make(chan struct{}, 1),
+		jobs:   make(chan *scheduledCheck),
+	}
+	go s.dispatch(ctx)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// add registers a host and schedules its first check one interval from now,
+// or at its schedule's next run.
+func (s *scheduler) add(spec hostSpec, interval time.Duration) {
+	registerHost(spec, interval)
+	host := spec.Host
+	c := &scheduledCheck{
+		host:     host,
+		interval: interval,
+		schedule: spec.Options.Schedule,
+		client:   newCheckClient(spec),
+		due:      firstDeadline(spec.Options.Schedule, interval),
+	}
+	s.mu.Lock()
+	s.checks[host] = c
+	s.mu.Unlock()
+	s.push(c)
+}
+
+// trigger moves host's next check to now and arranges for its status to be
+// sent on reply once that check has been recorded. A check already running
+// doesn't count, since it started before the request. It reports false for
+// unknown hosts.
+func (s *scheduler) trigger(host string, reply chan HostStatus) bool {
+	s.mu.Lock()
+	c, ok := s.checks[host]
+	if ok {
+		c.replies = append(c.replies, reply)
+		if c.index >= 0 {
+			c.due = time.Now()
+			heap.Fix(&s.queue, c.index)
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// setInterval changes host's check interval, rescheduling its next check
+// from now. It reports false for unknown hosts.
+func (s *scheduler) setInterval(host string, interval time.Duration) bool {
+	s.mu.Lock()
+	c, ok := s.checks[host]
+	if ok {
+		c.interval = interval
+		if c.index >= 0 {
+			c.due = time.Now().Add(nextCheckDelay(interval))
+			heap.Fix(&s.queue, c.index)
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// remove stops scheduling host. A check already running is not requeued.
+func (s *scheduler) remove(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.checks[host]
+	if !ok {
+		return
+	}
+	delete(s.checks, host)
+	c.removed = true
+	if c.index >= 0 {
+		heap.Remove(&s.queue, c.index)
+	}
+}
+
+// push queues a check and wakes the dispatcher.
+func (s *scheduler) push(c *scheduledCheck) {
+	s.mu.Lock()
+	heap.Push(&s.queue, c)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch sleeps until the earliest check is due and hands it to a worker.
+// When ctx is cancelled it stops handing out checks and releases the workers.
+func (s *scheduler) dispatch(ctx context.Context) {
+	defer close(s.jobs)
+	for {
+		s.mu.Lock()
+		wait := time.Duration(-1)
+		if len(s.queue) > 0 {
+			wait = time.Until(s.queue[0].due)
+			if wait <= 0 {
+				c := heap.Pop(&s.queue).(*scheduledCheck)
+				c.running, c.replies = c.replies, nil
+				s.mu.Unlock()
+				select {
+				case s.jobs <- c: // Blocks while every worker is busy
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+		}
+		s.mu.Unlock()
+
+		if wait < 0 {
+			select {
+			case <-s.wake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// work runs checks handed out by the dispatcher and requeues each host for
+// its next interval.
+func (s *scheduler) work() {
+	for c := range s.jobs {
+		backoff := runCheck(c.client, c.host)
+
+		s.mu.Lock()
+		waiting := c.running
+		c.running = nil
+		c.due = postpone(nextDeadline(c.schedule, c.due, c.interval), backoff)
+		if len(c.replies) > 0 {
+			// Triggered while this check ran; run another straight away
+			c.due = time.Now()
+		}
+		removed := c.removed
+		s.mu.Unlock()
+
+		if len(waiting) > 0 {
+			status, _ := localStatus(c.host)
+			for _, reply := range waiting {
+				reply <- status
+			}
+		}
+		if !removed {
+			s.push(c)
+		}
+	}
+}
+
+// recordResult stores a check result in the host's status and publishes a
+// TransitionEvent when the status changed.
+func recordResult(host string, result checkResult) {
+	mu.Lock()
+	currentStatus, ok := hostStatuses[host]
+	if !ok {
+		// The host stopped being monitored while this check ran
+		mu.Unlock()
+		return
+	}
+	previous := currentStatus.Status
+	result = hostConfigs[host].Options.expectDown(result, time.Now())
+	if result.Status == "DOWN" && !currentStatus.EverUp {
+		result.Status = "UNREACHABLE"
+	}
+	if currentStatus.Status != result.Status {
+		currentStatus.LastTransition = time.Now()
+	}
+	if result.Status == "UP" {
+		// The outage is over, so the next one needs acknowledging afresh
+		currentStatus.AckedAt = nil
+	}
+	currentStatus.Status = result.Status
+	currentStatus.LastError = result.Err
+	currentStatus.FailureReason = result.Reason
+	currentStatus.Metric = result.Metric
+	currentStatus.TLSVersion = result.TLSVersion
+	currentStatus.TLSCipher = result.TLSCipher
+	currentStatus.ContentEncoding = result.ContentEncoding
+	currentStatus.IPv4Status = result.IPv4Status
+	currentStatus.IPv6Status = result.IPv6Status
+	currentStatus.WireBytes = result.WireBytes
+	currentStatus.BodyBytes = result.BodyBytes
+	currentStatus.Redirects = result.Redirects
+	currentStatus.Proto = result.Proto
+	// Use float64 for type conversion
+	currentStatus.LatencyMs = float64(int(result.LatencyMs*100)) / 100.0 // Round to 2 decimals
+	currentStatus.PacketLoss = float64(int(result.PacketLoss*10)) / 10.0 // Round to 1 decimal
+	currentStatus.LastCheck = time.Now()
+	currentStatus.CheckCount++
+	currentStatus.RetryAt = nil
+	if result.RetryAfter > 0 {
+		retryAt := currentStatus.LastCheck.Add(result.RetryAfter)
+		currentStatus.RetryAt = &retryAt
+	}
+	var sloEvent *TransitionEvent
+	if stats, ok := hostStatsMap[host]; ok {
+		stats.record(checkSample{
+			Time:      currentStatus.LastCheck,
+			Status:    currentStatus.Status,
+			LatencyMs: currentStatus.LatencyMs,
+		})
+		currentStatus.LastSuccess = stats.LastSuccess
+		currentStatus.EverUp = currentStatus.EverUp || stats.UpChecks > 0
+		currentStatus.UptimePercent = stats.uptimePercent()
+		currentStatus.MTBF, currentStatus.MTTR = stats.reliability()
+		if currentStatus.SLOMs > 0 && currentStatus.Status != expectedDownStatus {
+			sloEvent = recordSLO(&currentStatus, &stats.slo)
+		}
+		if result.LatencyMs > 0 {
+			stats.latency.observe(result.LatencyMs/1000, result.TraceID, currentStatus.LastCheck)
+		}
+		stats.traffic.add(result)
+	}
+	hostStatuses[host] = currentStatus
+	withheld, summary := noteMaintenance(host, currentStatus)
+	if incidentWindow > 0 && !withheld {
+		noteIncident(host, previous, currentStatus)
+	}
+	mu.Unlock()
+	bumpVersion()
+
+	if emitLog == "checks" {
+		emitLogLine(logLine{
+			Time:      currentStatus.LastCheck,
+			Event:     "check",
+			Host:      host,
+			Status:    currentStatus.Status,
+			LatencyMs: currentStatus.LatencyMs,
+			Error:     currentStatus.LastError,
+			Reason:    currentStatus.FailureReason,
+		})
+	}
+	if resultQueue != nil {
+		queueResult(currentStatus)
+	}
+
+	if summary != nil {
+		publishMaintenanceSummary(summary)
+	}
+	if sloEvent != nil && !withheld {
+		publishTransition(*sloEvent)
+	}
+
+	// The first result after startup is only news if the host is not UP.
+	// Nor is leaving the expected_up window, or coming back up at its start,
+	// unless that ends an outage.
+	expected := currentStatus.Status == expectedDownStatus && statusCategory(previous) != "down" ||
+		previous == expectedDownStatus && currentStatus.Status == "UP"
+	if previous != currentStatus.Status && (previous != "PENDING" || currentStatus.Status != "UP") && !expected {
+		if withheld {
+			log.Printf("Transition during maintenance: %s is %s (was %s)", host, currentStatus.Status, previous)
+			return
+		}
+		publishTransition(TransitionEvent{
+			Host:      host,
+			OldStatus: previous,
+			NewStatus: currentStatus.Status,
+			Timestamp: currentStatus.LastTransition,
+			LatencyMs: currentStatus.LatencyMs,
+			Error:     currentStatus.LastError,
+			Reason:    currentStatus.FailureReason,
+		})
+	}
+}
+
+// Pseudo-statuses used by latency SLO burn alerts. They never appear as a
+// host's Status.
+const (
+	sloOKStatus      = "SLO_OK"
+	sloBurningStatus = "SLO_BURNING"
+)
+
+// sloMinSamples is how many checks must be in the window before a burn
+// alert can fire, so one slow check right after startup isn't a burn.
+const sloMinSamples = 10
+
+// recordSLO scores the check just stored in status against its latency
+// objective and returns an event when the breach rate over -slo-window
+// crosses -slo-alert-percent in either direction. mu must be held.
+func recordSLO(status *HostStatus, tracker *sloTracker) *TransitionEvent {
+	breached := status.Status != "UP" || status.LatencyMs > status.SLOMs
+	if breached {
+		status.SLOBreaches++
+	}
+	status.SLOBreachPercent = tracker.record(status.LastCheck, breached, sloWindow)
+
+	event := &TransitionEvent{
+		Host:      status.Host,
+		Timestamp: status.LastCheck,
+		LatencyMs: status.LatencyMs,
+		Error: fmt.Sprintf("%.1f%% of checks in the last %v exceeded %gms (threshold %g%%)",
+			status.SLOBreachPercent, sloWindow, status.SLOMs, sloAlertPercent),
+	}
+	switch {
+	case !tracker.burning && status.SLOBreachPercent > sloAlertPercent && len(tracker.samples) >= sloMinSamples:
+		tracker.burning = true
+		event.OldStatus, event.NewStatus = sloOKStatus, sloBurningStatus
+		return event
+	case tracker.burning && status.SLOBreachPercent <= sloAlertPercent:
+		tracker.burning = false
+		event.OldStatus, event.NewStatus = sloBurningStatus, sloOKStatus
+		return event
+	}
+	return nil
+}
+
+// TransitionEvent describes a host changing status. It is what notifiers
+// are given to alert on.
+type TransitionEvent struct {
+	Host      string    `json:"host"`
+	OldStatus string    `json:"oldStatus"`
+	NewStatus string    `json:"newStatus"`
+	Timestamp time.Time `json:"timestamp"`
+	LatencyMs float64   `json:"latencyMs"`
+	Error     string    `json:"error,omitempty"`
+	// Reason classifies Error.
+	Reason FailureReason `json:"reason,omitempty"`
+	// Quiet marks an event held back during the host's quiet hours and
+	// sent in the digest that follows them.
+	Quiet bool `json:"quiet,omitempty"`
+	// Incident is the ID of the incident the failure is part of, for the
+	// failures sent together as one incident alert.
+	Incident int `json:"incident,omitempty"`
+}
+
+// Summary renders the event as a one-line human readable message.
+func (e TransitionEvent) Summary() string {
+	msg := fmt.Sprintf("%s is %s (was %s)", e.Host, e.NewStatus, e.OldStatus)
+	switch e.OldStatus {
+	case e.NewStatus:
+		// A reminder that a failure is ongoing
+		msg = fmt.Sprintf("%s is still %s", e.Host, e.NewStatus)
+	case maintenanceStatus:
+		msg = fmt.Sprintf("%s is %s after maintenance", e.Host, e.NewStatus)
+	}
+	switch e.NewStatus {
+	case sloBurningStatus:
+		msg = fmt.Sprintf("%s is burning its latency SLO", e.Host)
+	case sloOKStatus:
+		msg = fmt.Sprintf("%s is back within its latency SLO", e.Host)
+	}
+	if e.Error != "" {
+		msg += ": " + e.Error
+	}
+	return msg
+}
+
+// Notifier is an alert backend that delivers transition events.
+type Notifier interface {
+	// Name identifies the backend in logs and configuration output.
+	Name() string
+	Notify(event TransitionEvent) error
+}
+
+// digestNotifier is implemented by notifiers that can deliver several
+// events as a single message. Notifiers without it get one Notify call per
+// event.
+type digestNotifier interface {
+	NotifyDigest(events []TransitionEvent) error
+}
+
+// notifiers are the enabled alert backends, built from flags at startup.
+var notifiers []Notifier
+
+// transitionEvents queues events for delivery so slow backends never hold
+// up a host's checks.
+var transitionEvents = make(chan TransitionEvent, 256)
+
+// logLine is the JSON line written to stdout for each check or transition
+// with -emit-log, for log pipelines to alert on.
+type logLine struct {
+	Time           time.Time     `json:"time"`
+	Event          string        `json:"event"` // "check" or "transition"
+	Host           string        `json:"host"`
+	Status         string        `json:"status"`
+	PreviousStatus string        `json:"previousStatus,omitempty"`
+	LatencyMs      float64       `json:"latencyMs"`
+	Error          string        `json:"error,omitempty"`
+	Reason         FailureReason `json:"reason,omitempty"`
+}
+
+// emitLogMu keeps concurrent -emit-log lines from interleaving.
+var emitLogMu sync.Mutex
+
+// emitLogLine writes line to stdout as one line of JSON. The regular log
+// goes to stderr, so stdout carries nothing else.
+func emitLogLine(line logLine) {
+	data, err := json.Marshal(line)
+	if err != nil {
+		log.Printf("Error marshalling log line: %v", err)
+		return
+	}
+	emitLogMu.Lock()
+	defer emitLogMu.Unlock()
+	os.Stdout.Write(append(data, '\n'))
+}
+
+// notifyClient is the HTTP client used by webhook-style notifiers.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// resultQueueSize bounds the results waiting to be sent to -result-webhook.
+// Results that arrive while it is full, because the collector is slow or
+// down, are dropped rather than holding up the checks.
+const resultQueueSize = 1000
+
+var (
+	// resultQueue carries each check's status to sendResults. It is nil
+	// without -result-webhook.
+	resultQueue chan HostStatus
+	// droppedResults counts the results dropped from a full resultQueue.
+	droppedResults atomic.Int64
+)
+
+// resultBatch is the body of a -result-webhook request.
+type resultBatch struct {
+	SentAt  time.Time    `json:"sentAt"`
+	Results []HostStatus `json:"results"` // Oldest first
+	// Dropped is how many results were dropped since the previous batch,
+	// so the collector knows its data has gaps.
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+// queueResult hands a check's status to sendResults without blocking.
+func queueResult(status HostStatus) {
+	select {
+	case resultQueue <- status:
+	default:
+		// Logged by sendResults with its next batch
+		droppedResults.Add(1)
+	}
+}
+
+// sendResults POSTs the results from queue to -result-webhook in batches:
+// each is sent once -result-batch-window has passed since its first result
+// or once it holds -result-batch-size results, whichever is sooner. Batches
+// are sent one at a time, and one that fails is not retried, so that a slow
+// collector costs only the results that overflow the queue meanwhile.
+func sendResults(queue <-chan HostStatus) {
+	var batch []HostStatus
+	var flush <-chan time.Time
+	var reported int64 // droppedResults as of the previous batch
+	for {
+		select {
+		case status := <-queue:
+			if len(batch) == 0 {
+				flush = time.After(resultBatchWindow)
+			}
+			batch = append(batch, status)
+			if len(batch) < resultBatchSize {
+				continue
+			}
+		case <-flush:
+		}
+
+		dropped := droppedResults.Load()
+		err := postJSON(resultWebhook, resultBatch{SentAt: time.Now(), Results: batch, Dropped: dropped - reported})
+		if err != nil {
+			log.Printf("Error sending %d results to -result-webhook: %v", len(batch), err)
+		}
+		if dropped > reported {
+			log.Printf("Result webhook dropped %d results since its previous batch", dropped-reported)
+		}
+		reported = dropped
+		batch, flush = nil, nil
+	}
+}
+
+// publishTransition queues an event for the notifiers, dropping it (with a
+// log line) if the queue is full.
+func publishTransition(event TransitionEvent) {
+	log.Printf("Transition: %s", event.Summary())
+	if emitLog == "transitions" {
+		emitLogLine(logLine{
+			Time:           event.Timestamp,
+			Event:          "transition",
+			Host:           event.Host,
+			Status:         event.NewStatus,
+			PreviousStatus: event.OldStatus,
+			LatencyMs:      event.LatencyMs,
+			Error:          event.Error,
+		})
+	}
+	transitionFeed.broadcast(event)
+	if len(notifiers) == 0 {
+		return
+	}
+	select {
+	case transitionEvents <- event:
+	default:
+		log.Printf("Notification queue full, dropping event for %s", event.Host)
+	}
+}
+
+// transitionBroadcaster fans transition events out to the clients of
+// /events/transitions.
+type transitionBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan TransitionEvent]struct{}
+}
+
+// transitionFeed carries every published transition to SSE subscribers.
+var transitionFeed = &transitionBroadcaster{subscribers: make(map[chan TransitionEvent]struct{})}
+
+// subscribe registers a new subscriber channel.
+func (b *transitionBroadcaster) subscribe() chan TransitionEvent {
+	ch := make(chan TransitionEvent, 64)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// unsubscribe removes a channel returned by subscribe.
+func (b *transitionBroadcaster) unsubscribe(ch chan TransitionEvent) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+// broadcast sends event to every subscriber. A subscriber that has fallen
+// too far behind misses the event rather than holding up the checks.
+func (b *transitionBroadcaster) broadcast(event TransitionEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Transition stream subscriber too slow, dropping event for %s", event.Host)
+		}
+	}
+}
+
+// alertManager sits between transition detection and the notifiers. It
+// groups events that arrive within groupWindow into one digest, suppresses
+// further failure alerts for a host that is already alerting, and re-sends a
+// reminder every repeatInterval while a host stays failed.
+type alertManager struct {
+	groupWindow    time.Duration
+	repeatInterval time.Duration
+	incidentAlerts bool // Failures wait -incident-window to be alerted on as incidents
+
+	pending  []TransitionEvent
+	alerting map[string]time.Time // host -> when a failure alert was last sent
+
+	// Escalation to notifiers with an -*-after delay: failures waiting for
+	// their delay to pass, and the delayed notifiers already told about each
+	// host's current outage (which therefore also hear of its recovery).
+	escalations map[string][]escalation
+	escalated   map[string]map[string]bool // host -> notifier name
+
+	// quietHeld holds events that happened during their host's quiet
+	// hours, to be sent as one digest once those hours are over.
+	quietHeld []TransitionEvent
+
+	// incidentHeld holds hosts' new failures for -incident-window, so the
+	// failures of hosts that turn out to share an incident are sent as one
+	// alert.
+	incidentHeld []TransitionEvent
+}
+
+// escalation is a failure alert held back from a delayed notifier until
+// due, and dropped if the host recovers first.
+type escalation struct {
+	notifier Notifier
+	event    TransitionEvent
+	due      time.Time
+}
+
+// newAlertManager creates an alert manager using the -alert-* and
+// -incident-window flags.
+func newAlertManager() *alertManager {
+	return &alertManager{
+		groupWindow:    alertGroupWindow,
+		repeatInterval: alertRepeatInterval,
+		// Holding alerts delays them, so the default window only groups
+		// incidents for /api/incidents
+		incidentAlerts: incidentWindow > 0 && flagWasSet("incident-window"),
+		alerting:       make(map[string]time.Time),
+		escalations:    make(map[string][]escalation),
+		escalated:      make(map[string]map[string]bool),
+	}
+}
+
+// notifierDelays holds each notifier's -*-after delay by name. Notifiers
+// without one are told about failures immediately.
+var notifierDelays = make(map[string]time.Duration)
+
+// unreachableNotifiers holds the names of the notifiers picked by
+// -unreachable-notify, or is nil when it is "all".
+var unreachableNotifiers map[string]bool
+
+// notifiesUnreachable reports whether n is told about UNREACHABLE hosts,
+// including their first time UP.
+func notifiesUnreachable(n Notifier) bool {
+	return unreachableNotifiers == nil || unreachableNotifiers[n.Name()]
+}
+
+// run consumes events until the channel is closed. Maintenance summaries
+// bypass grouping and are delivered as soon as they arrive.
+func (m *alertManager) run(events <-chan TransitionEvent, summaries <-chan []TransitionEvent) {
+	var flushC <-chan time.Time
+
+	var repeatC <-chan time.Time
+	if m.repeatInterval > 0 {
+		ticker := time.NewTicker(m.repeatInterval / 2)
+		defer ticker.Stop()
+		repeatC = ticker.C
+	}
+
+	var escalateC <-chan time.Time
+	if len(notifierDelays) > 0 {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		escalateC = ticker.C
+	}
+
+	var incidentC <-chan time.Time
+	if m.incidentAlerts {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		incidentC = ticker.C
+	}
+
+	// Held events are looked at every so often, as quiet hours may end
+	// without any new event arriving
+	quietTicker := time.NewTicker(30 * time.Second)
+	defer quietTicker.Stop()
+
+	// schedule sends the pending events, at once or when the group window
+	// opened by the first of them has passed
+	schedule := func() {
+		if m.groupWindow <= 0 {
+			m.flush()
+		} else if flushC == nil && len(m.pending) > 0 {
+			// The first event of a group opens the window
+			flushC = time.After(m.groupWindow)
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				m.pending = append(m.pending, m.incidentHeld...)
+				m.flush()
+				return
+			}
+			if !m.admit(event) {
+				continue
+			}
+			if m.incidentAlerts && opensOutage(event) {
+				// Held to see whether other hosts are failing with it
+				m.incidentHeld = append(m.incidentHeld, event)
+				continue
+			}
+			if endsOutage(event.NewStatus) {
+				// A failure still held is sent ahead of its recovery
+				m.incidentHeld = slices.DeleteFunc(m.incidentHeld, func(held TransitionEvent) bool {
+					if held.Host != event.Host {
+						return false
+					}
+					m.pending = append(m.pending, held)
+					return true
+				})
+			}
+			m.pending = append(m.pending, event)
+			schedule()
+
+		case summary := <-summaries:
+			// The summary replaces the hosts' individual recovery alerts, so
+			// it must also update their alerting state
+			for _, event := range summary {
+				if endsOutage(event.NewStatus) {
+					delete(m.alerting, event.Host)
+					delete(m.escalations, event.Host)
+					delete(m.escalated, event.Host)
+				} else {
+					m.alerting[event.Host] = event.Timestamp
+				}
+			}
+			deliver(m.holdQuiet(summary, time.Now()))
+
+		case <-flushC:
+			flushC = nil
+			m.flush()
+
+		case <-repeatC:
+			m.remind()
+			if flushC == nil {
+				m.flush()
+			}
+
+		case now := <-escalateC:
+			m.escalate(now)
+
+		case now := <-incidentC:
+			m.releaseIncidents(now)
+			schedule()
+
+		case now := <-quietTicker.C:
+			m.releaseQuiet(now)
+		}
+	}
+}
+
+// holdQuiet moves the events of hosts in their quiet hours to quietHeld and
+// returns the rest. Reminders are dropped rather than held, as the digest
+// covers the outage.
+func (m *alertManager) holdQuiet(events []TransitionEvent, now time.Time) []TransitionEvent {
+	var send []TransitionEvent
+	for _, event := range events {
+		if !quietHoursFor(event.Host).contains(now) {
+			send = append(send, event)
+			continue
+		}
+		if event.OldStatus == event.NewStatus {
+			continue
+		}
+		log.Printf("Quiet hours: holding alert for %s (%s)", event.Host, event.NewStatus)
+		event.Quiet = true
+		m.quietHeld = append(m.quietHeld, event)
+	}
+	return send
+}
+
+// releaseQuiet sends the held events of hosts whose quiet hours have ended
+// as a single digest.
+func (m *alertManager) releaseQuiet(now time.Time) {
+	if len(m.quietHeld) == 0 {
+		return
+	}
+	var released, still []TransitionEvent
+	for _, event := range m.quietHeld {
+		if quietHoursFor(event.Host).contains(now) {
+			still = append(still, event)
+		} else {
+			released = append(released, event)
+		}
+	}
+	m.quietHeld = still
+	if len(released) > 0 {
+		log.Printf("Quiet hours over: sending %d held alerts", len(released))
+		deliver(released)
+	}
+}
+
+// opensOutage reports whether event is a host starting to fail, which may
+// make it part of an incident.
+func opensOutage(event TransitionEvent) bool {
+	if event.NewStatus == sloBurningStatus || event.NewStatus == sloOKStatus {
+		return false
+	}
+	return statusCategory(event.NewStatus) == "down" && statusCategory(event.OldStatus) != "down"
+}
+
+// releaseIncidents sends the held failures whose incident has stopped
+// growing, each incident's as one alert, and passes on those that can no
+// longer become part of an incident to the pending events.
+func (m *alertManager) releaseIncidents(now time.Time) {
+	var still []TransitionEvent
+	var groups [][]TransitionEvent
+	group := make(map[int]int) // Incident ID -> index in groups
+	for _, event := range m.incidentHeld {
+		id, growing := incidentOf(event.Host, event.Timestamp, now)
+		switch {
+		case growing, id == 0 && now.Sub(event.Timestamp) <= incidentWindow:
+			still = append(still, event)
+		case id == 0:
+			m.pending = append(m.pending, event)
+		default:
+			event.Incident = id
+			if i, ok := group[id]; ok {
+				groups[i] = append(groups[i], event)
+			} else {
+				group[id] = len(groups)
+				groups = append(groups, []TransitionEvent{event})
+			}
+		}
+	}
+	m.incidentHeld = still
+	for _, events := range groups {
+		log.Printf("Incident %d: sending one alert for %d hosts", events[0].Incident, len(events))
+		m.send(events)
+	}
+}
+
+// admit updates the alerting state for an event and reports whether it
+// should be sent.
+func (m *alertManager) admit(event TransitionEvent) bool {
+	if event.NewStatus == sloBurningStatus || event.NewStatus == sloOKStatus {
+		// SLO alerts fire once per crossing and are separate from outages
+		return true
+	}
+	if endsOutage(event.NewStatus) {
+		delete(m.alerting, event.Host)
+		return true
+	}
+	if _, ok := m.alerting[event.Host]; ok {
+		// Already alerted on this outage; reminders cover it from here
+		log.Printf("Suppressing repeat alert for %s (%s)", event.Host, event.NewStatus)
+		return false
+	}
+	m.alerting[event.Host] = event.Timestamp
+	return true
+}
+
+// remind queues a reminder for each host that has been failing for longer
+// than the repeat interval since its last alert, unless its outage has been
+// acknowledged.
+func (m *alertManager) remind() {
+	now := time.Now()
+	statuses := snapshotStatuses()
+	for host, lastSent := range m.alerting {
+		if now.Sub(lastSent) < m.repeatInterval {
+			continue
+		}
+		status, ok := statuses[host]
+		if !ok || status.Status == "UP" || status.AckedAt != nil {
+			continue
+		}
+		m.alerting[host] = now
+		m.pending = append(m.pending, TransitionEvent{
+			Host:      host,
+			OldStatus: status.Status,
+			NewStatus: status.Status,
+			Timestamp: now,
+			LatencyMs: status.LatencyMs,
+			Error:     status.LastError,
+			Reason:    status.FailureReason,
+		})
+	}
+}
+
+// flush delivers the pending events to every notifier, as a digest when
+// there is more than one.
+func (m *alertManager) flush() {
+	if len(m.pending) == 0 {
+		return
+	}
+	events := m.pending
+	m.pending = nil
+	m.send(events)
+}
+
+// send delivers events to every notifier that they are routed to, as a
+// digest when there is more than one.
+func (m *alertManager) send(events []TransitionEvent) {
+	events = m.holdQuiet(events, time.Now())
+	for _, n := range notifiers {
+		var selected []TransitionEvent
+		for _, event := range events {
+			if m.route(n, event) {
+				selected = append(selected, event)
+			}
+		}
+		deliverTo(n, selected)
+	}
+
+	// Recoveries end the outage for escalation purposes too
+	for _, event := range events {
+		if endsOutage(event.NewStatus) {
+			delete(m.escalations, event.Host)
+			delete(m.escalated, event.Host)
+		}
+	}
+}
+
+// route reports whether n should be sent event now. A new failure for a
+// delayed notifier is queued as an escalation instead; reminders and
+// recoveries only reach delayed notifiers that were told of the failure.
+func (m *alertManager) route(n Notifier, event TransitionEvent) bool {
+	if (event.NewStatus == "UNREACHABLE" || event.OldStatus == "UNREACHABLE") && !notifiesUnreachable(n) {
+		return false
+	}
+	delay := notifierDelays[n.Name()]
+	switch {
+	case delay <= 0:
+		return true
+	case event.NewStatus == sloBurningStatus || event.NewStatus == sloOKStatus:
+		return true
+	case endsOutage(event.NewStatus) || event.OldStatus == event.NewStatus:
+		return m.escalated[event.Host][n.Name()]
+	default:
+		m.escalations[event.Host] = append(m.escalations[event.Host], escalation{
+			notifier: n,
+			event:    event,
+			due:      event.Timestamp.Add(delay),
+		})
+		return false
+	}
+}
+
+// escalate sends each escalation that has come due, provided its host is
+// still failing and nobody has acknowledged the outage.
+func (m *alertManager) escalate(now time.Time) {
+	if len(m.escalations) == 0 {
+		return
+	}
+	statuses := snapshotStatuses()
+	for host, waiting := range m.escalations {
+		var remaining []escalation
+		for _, e := range waiting {
+			// An escalation due in quiet hours waits for them to end
+			if now.Before(e.due) || quietHoursFor(host).contains(now) {
+				remaining = append(remaining, e)
+				continue
+			}
+			status, ok := statuses[host]
+			if !ok || endsOutage(status.Status) {
+				continue
+			}
+			if status.AckedAt != nil {
+				log.Printf("Not escalating alert for %s to %s: acknowledged", host, e.notifier.Name())
+				continue
+			}
+			log.Printf("Escalating alert for %s to %s", host, e.notifier.Name())
+			deliverTo(e.notifier, []TransitionEvent{e.event})
+			if m.escalated[host] == nil {
+				m.escalated[host] = make(map[string]bool)
+			}
+			m.escalated[host][e.notifier.Name()] = true
+		}
+		if len(remaining) == 0 {
+			delete(m.escalations, host)
+		} else {
+			m.escalations[host] = remaining
+		}
+	}
+}
+
+// deliver sends events to every enabled notifier.
+func deliver(events []TransitionEvent) {
+	for _, n := range notifiers {
+		deliverTo(n, events)
+	}
+}
+
+// deliverTo sends events to one notifier, as a digest when there is more
+// than one and the notifier supports it.
+func deliverTo(n Notifier, events []TransitionEvent) {
+	if len(events) == 0 {
+		return
+	}
+	if until := globalMaintenanceUntil(time.Now()); until != nil {
+		log.Printf("Withholding %d events from %s: the monitor is in maintenance until %s", len(events), n.Name(), until.Format(time.RFC3339))
+		return
+	}
+	if digest, ok := n.(digestNotifier); ok && len(events) > 1 {
+		if err := digest.NotifyDigest(events); err != nil {
+			log.Printf("Notifier %s failed for digest of %d events: %v", n.Name(), len(events), err)
+		}
+		return
+	}
+	for _, event := range events {
+		if err := n.Notify(event); err != nil {
+			log.Printf("Notifier %s failed for %s: %v", n.Name(), event.Host, err)
+		}
+	}
+}
+
+// digestTitle describes a batch of events for a digest's heading.
+func digestTitle(events []TransitionEvent) string {
+	if id := events[0].Incident; id != 0 && !slices.ContainsFunc(events, func(e TransitionEvent) bool { return e.Incident != id }) {
+		return fmt.Sprintf("Incident %d: %d hosts failed together", id, len(events))
+	}
+	if !slices.ContainsFunc(events, func(e TransitionEvent) bool { return !e.Quiet }) {
+		return fmt.Sprintf("Quiet hours summary: %d status changes", len(events))
+	}
+	up := 0
+	for _, event := range events {
+		if event.OldStatus != maintenanceStatus {
+			return fmt.Sprintf("%d hosts changed status", len(events))
+		}
+		if event.NewStatus == "UP" {
+			up++
+		}
+	}
+	return fmt.Sprintf("Maintenance complete: %d of %d hosts UP", up, len(events))
+}
+
+// quietHours is a daily time range during which a host's alerts are held
+// back, e.g. 22:00-07:00 in a given time zone. A range that starts and ends
+// at the same time is never quiet, which lets a host opt out of the global
+// -quiet-hours.
+type quietHours struct {
+	start, end int // Minutes after midnight
+	loc        *time.Location
+	spec       string
+}
+
+// parseQuietHours parses "HH:MM-HH:MM", optionally followed by @ and an
+// IANA time zone (default local time), or "off".
+func parseQuietHours(spec string) (*quietHours, error) {
+	if spec == "off" {
+		return &quietHours{loc: time.Local, spec: spec}, nil
+	}
+	span, zone, hasZone := strings.Cut(spec, "@")
+	q := &quietHours{loc: time.Local, spec: spec}
+	if hasZone {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", zone)
+		}
+		q.loc = loc
+	}
+	from, to, ok := strings.Cut(span, "-")
+	if !ok {
+		return nil, fmt.Errorf("%q must look like 22:00-07:00[@Zone]", spec)
+	}
+	for _, part := range []struct {
+		value string
+		dst   *int
+	}{{from, &q.start}, {to, &q.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part.value))
+		if err != nil {
+			return nil, fmt.Errorf("%q must look like 22:00-07:00[@Zone]", spec)
+		}
+		*part.dst = t.Hour()*60 + t.Minute()
+	}
+	return q, nil
+}
+
+// contains reports whether t falls in the quiet hours. The range may wrap
+// past midnight. A nil quietHours is never quiet.
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil || q.start == q.end {
+		return false
+	}
+	local := t.In(q.loc)
+	minute := local.Hour()*60 + local.Minute()
+	if q.start < q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// String returns the spec the quiet hours were parsed from.
+func (q *quietHours) String() string {
+	if q == nil {
+		return ""
+	}
+	return q.spec
+}
+
+// globalQuietHours is parsed from -quiet-hours; nil when unset.
+var globalQuietHours *quietHours
+
+// quietHoursFor returns a host's quiet hours. mu must not be held.
+func quietHoursFor(host string) *quietHours {
+	mu.RLock()
+	spec := hostConfigs[host]
+	mu.RUnlock()
+	return spec.Options.quietHours()
+}
+
+// quietHours returns the host's quiet hours: its own quiet option, else
+// -quiet-hours.
+func (o hostOptions) quietHours() *quietHours {
+	if o.Quiet != nil {
+		return o.Quiet
+	}
+	return globalQuietHours
+}
+
+// maintenanceStatus is the OldStatus of the events in a maintenance summary.
+const maintenanceStatus = "MAINTENANCE"
+
+// maintenanceWindow withholds alerts for a set of hosts from Start until
+// End. Once every host has been checked after End, a single summary of
+// their states is sent in place of individual recovery alerts.
+//
+// A Global window puts the whole monitor in maintenance: it covers every
+// host, including ones added while it runs, and no notifications at all
+// are sent until it ends.
+type maintenanceWindow struct {
+	ID     int       `json:"id"`
+	Hosts  []string  `json:"hosts"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Global bool      `json:"global,omitempty"`
+
+	// results holds each host's first check after End
+	results map[string]TransitionEvent
+}
+
+// Active maintenance windows by ID, protected by mu.
+var (
+	maintenanceWindows = make(map[int]*maintenanceWindow)
+	lastMaintenanceID  int
+)
+
+// maintenanceSummaries queues completed maintenance summaries for the alert
+// manager.
+var maintenanceSummaries = make(chan []TransitionEvent, 16)
+
+// covers reports whether the window applies to host.
+func (win *maintenanceWindow) covers(host string) bool {
+	return win.Global || slices.Contains(win.Hosts, host)
+}
+
+// activeAt reports whether the window is running at t.
+func (win *maintenanceWindow) activeAt(t time.Time) bool {
+	return !t.Before(win.Start) && t.Before(win.End)
+}
+
+// noteMaintenance applies any maintenance windows covering host to a newly
+// recorded status. It reports whether the check's transition should be
+// withheld, and returns a window's summary once its last host still being
+// monitored has been checked after the window ended. mu must be held.
+func noteMaintenance(host string, status HostStatus) (withheld bool, summary []TransitionEvent) {
+	for id, win := range maintenanceWindows {
+		if !win.covers(host) || status.LastCheck.Before(win.Start) {
+			continue
+		}
+		if status.LastCheck.Before(win.End) {
+			withheld = true
+			continue
+		}
+		if _, done := win.results[host]; done {
+			// Later checks alert normally while other hosts catch up
+			continue
+		}
+		withheld = true
+		win.results[host] = TransitionEvent{
+			Host:      host,
+			OldStatus: maintenanceStatus,
+			NewStatus: status.Status,
+			Timestamp: status.LastCheck,
+			LatencyMs: status.LatencyMs,
+			Error:     status.LastError,
+			Reason:    status.FailureReason,
+		}
+		if !slices.Contains(win.Hosts, host) {
+			// Added during a global window
+			win.Hosts = append(win.Hosts, host)
+		}
+		// Hosts no longer monitored won't be checked again, so aren't
+		// waited for
+		if slices.ContainsFunc(win.Hosts, func(h string) bool {
+			_, done := win.results[h]
+			_, monitored := hostStatuses[h]
+			return !done && monitored
+		}) {
+			continue
+		}
+		for _, h := range win.Hosts {
+			if result, ok := win.results[h]; ok {
+				summary = append(summary, result)
+			}
+		}
+		delete(maintenanceWindows, id)
+	}
+	return withheld, summary
+}
+
+// publishMaintenanceSummary logs a completed maintenance window and queues
+// it for the notifiers.
+func publishMaintenanceSummary(summary []TransitionEvent) {
+	log.Printf("%s", digestTitle(summary))
+	for _, event := range summary {
+		log.Printf("  %s", event.Summary())
+	}
+	if len(notifiers) == 0 {
+		return
+	}
+	select {
+	case maintenanceSummaries <- summary:
+	default:
+		log.Printf("Notification queue full, dropping maintenance summary")
+	}
+}
+
+// maintenanceUntil returns when the latest maintenance window covering host
+// ends, or nil if there is none running. mu must be held.
+func maintenanceUntil(host string, now time.Time) *time.Time {
+	var until *time.Time
+	for _, win := range maintenanceWindows {
+		if win.activeAt(now) && win.covers(host) && (until == nil || win.End.After(*until)) {
+			end := win.End
+			until = &end
+		}
+	}
+	return until
+}
+
+// globalMaintenanceUntil returns when the latest global maintenance window
+// running ends, or nil if the monitor is not in maintenance.
+func globalMaintenanceUntil(now time.Time) *time.Time {
+	mu.RLock()
+	defer mu.RUnlock()
+	var until *time.Time
+	for _, win := range maintenanceWindows {
+		if win.Global && win.activeAt(now) && (until == nil || win.End.After(*until)) {
+			end := win.End
+			until = &end
+		}
+	}
+	return until
+}
+
+// incidentLogSize bounds how many incidents are kept.
+const incidentLogSize = 100
+
+// incident groups hosts that started failing together, which most likely
+// share a root cause such as a switch or a DNS outage.
+type incident struct {
+	ID    int              `json:"id"`
+	Start time.Time        `json:"start"`         // When the first member failed
+	End   *time.Time       `json:"end,omitempty"` // When the last member recovered
+	Hosts []incidentMember `json:"hosts"`         // In the order they failed
+}
+
+// incidentMember is one host's part in an incident.
+type incidentMember struct {
+	Host   string        `json:"host"`
+	Time   time.Time     `json:"time"` // The host's LastTransition on failing
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Reason FailureReason `json:"reason,omitempty"`
+}
+
+// Incident state, protected by mu.
+var (
+	incidents      []*incident      // Oldest first
+	recentFailures []incidentMember // Failures within -incident-window that are in no incident
+	lastIncidentID int
+)
+
+// noteIncident follows a host's status change for incident detection. A
+// host that starts failing joins the open incident whose latest member
+// failed within -incident-window, or opens a new one once
+// -incident-min-hosts hosts have failed within the window. An incident ends
+// when none of its members are failing. mu must be held.
+func noteIncident(host, previous string, status HostStatus) {
+	now := status.LastTransition
+	failing := statusCategory(status.Status) == "down"
+	if failing == (statusCategory(previous) == "down") {
+		// Still failing (e.g. DOWN to UNREACHABLE), or still not
+		return
+	}
+
+	if !failing {
+		recentFailures = slices.DeleteFunc(recentFailures, func(m incidentMember) bool { return m.Host == host })
+		for _, inc := range incidents {
+			if inc.End == nil && inc.has(host) && !inc.failing() {
+				inc.End = &now
+				log.Printf("Incident %d over: all %d hosts have recovered", inc.ID, len(inc.Hosts))
+			}
+		}
+		return
+	}
+
+	member := incidentMember{Host: host, Time: now, Status: status.Status, Error: status.LastError, Reason: status.FailureReason}
+	for _, inc := range incidents {
+		if inc.End == nil && now.Sub(inc.Hosts[len(inc.Hosts)-1].Time) <= incidentWindow {
+			if !inc.has(host) {
+				inc.Hosts = append(inc.Hosts, member)
+				log.Printf("Incident %d: %s failed too (%d hosts)", inc.ID, host, len(inc.Hosts))
+			}
+			return
+		}
+	}
+
+	recentFailures = slices.DeleteFunc(recentFailures, func(m incidentMember) bool {
+		return m.Host == host || now.Sub(m.Time) > incidentWindow
+	})
+	recentFailures = append(recentFailures, member)
+	if len(recentFailures) < incidentMinHosts {
+		return
+	}
+	lastIncidentID++
+	inc := &incident{ID: lastIncidentID, Start: recentFailures[0].Time, Hosts: recentFailures}
+	recentFailures = nil
+	incidents = append(incidents, inc)
+	if len(incidents) > incidentLogSize {
+		incidents = incidents[len(incidents)-incidentLogSize:]
+	}
+	log.Printf("Incident %d: %d hosts failed within %v, starting with %s", inc.ID, len(inc.Hosts), incidentWindow, inc.Hosts[0].Host)
+}
+
+// has reports whether host is a member of the incident.
+func (inc *incident) has(host string) bool {
+	return slices.ContainsFunc(inc.Hosts, func(m incidentMember) bool { return m.Host == host })
+}
+
+// failing reports whether any member is still failing. Hosts no longer
+// monitored count as recovered. mu must be held.
+func (inc *incident) failing() bool {
+	for _, m := range inc.Hosts {
+		if status, ok := hostStatuses[m.Host]; ok && statusCategory(status.Status) == "down" {
+			return true
+		}
+	}
+	return false
+}
+
+// incidentOf returns the ID of the incident that host's failure at t is
+// part of, or 0 if none, and whether more hosts may still join it.
+func incidentOf(host string, t, now time.Time) (id int, growing bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, inc := range incidents {
+		if slices.ContainsFunc(inc.Hosts, func(m incidentMember) bool { return m.Host == host && m.Time.Equal(t) }) {
+			return inc.ID, inc.End == nil && now.Sub(inc.Hosts[len(inc.Hosts)-1].Time) <= incidentWindow
+		}
+	}
+	return 0, false
+}
+
+// apiIncidentsHandler lists the incidents as JSON, oldest first.
+func apiIncidentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mu.RLock()
+	list := make([]incident, len(incidents))
+	for i, inc := range incidents {
+		list[i] = *inc
+		list[i].Hosts = slices.Clone(inc.Hosts)
+	}
+	mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"incidents": list}); err != nil {
+		log.Printf("Error encoding incidents JSON: %v", err)
+	}
+}
+
+// maintenanceRequest is the body of a POST to /api/maintenance. The window
+// runs from Start (default now) until End, or for Duration.
+type maintenanceRequest struct {
+	Hosts    []string   `json:"hosts"` // Empty means every local host
+	Global   bool       `json:"global"`
+	Start    *time.Time `json:"start"`
+	End      *time.Time `json:"end"`
+	Duration string     `json:"duration"`
+}
+
+// apiMaintenanceHandler manages maintenance windows: GET lists them, POST
+// schedules one, and DELETE ?id=N ends one early.
+func apiMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		mu.RLock()
+		windows := make([]maintenanceWindow, 0, len(maintenanceWindows))
+		for _, win := range maintenanceWindows {
+			copied := *win
+			copied.Hosts = slices.Clone(win.Hosts)
+			copied.results = nil
+			windows = append(windows, copied)
+		}
+		mu.RUnlock()
+		sort.Slice(windows, func(i, j int) bool { return windows[i].ID < windows[j].ID })
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(windows); err != nil {
+			log.Printf("Error encoding maintenance windows JSON: %v", err)
+		}
+
+	case http.MethodPost:
+		var req maintenanceRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBodyBytes)).Decode(&req); err != nil {
+			apiError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		start := now
+		if req.Start != nil && req.Start.After(now) {
+			start = *req.Start
+		}
+		var end time.Time
+		switch {
+		case req.End != nil && req.Duration != "":
+			apiError(w, "Give either end or duration, not both", http.StatusBadRequest)
+			return
+		case req.End != nil:
+			end = *req.End
+		default:
+			duration, err := time.ParseDuration(req.Duration)
+			if err != nil || duration <= 0 {
+				apiError(w, "Invalid duration: must be positive, e.g. 30m", http.StatusBadRequest)
+				return
+			}
+			end = start.Add(duration)
+		}
+		if !end.After(start) {
+			apiError(w, "Invalid end: must be after the start and in the future", http.StatusBadRequest)
+			return
+		}
+		if req.Global && len(req.Hosts) > 0 {
+			apiError(w, "A global window covers every host, so takes no hosts", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		hosts := req.Hosts
+		if len(hosts) == 0 {
+			for host := range hostStatuses {
+				hosts = append(hosts, host)
+			}
+		}
+		sort.Strings(hosts)
+		hosts = slices.Compact(hosts)
+		for _, host := range hosts {
+			if _, ok := hostStatuses[host]; !ok {
+				mu.Unlock()
+				apiError(w, "Unknown host: "+host, http.StatusBadRequest)
+				return
+			}
+		}
+		lastMaintenanceID++
+		win := &maintenanceWindow{
+			ID:      lastMaintenanceID,
+			Hosts:   hosts,
+			Start:   start,
+			End:     end,
+			Global:  req.Global,
+			results: make(map[string]TransitionEvent),
+		}
+		maintenanceWindows[win.ID] = win
+		created := *win
+		mu.Unlock()
+		bumpVersion()
+
+		switch {
+		case created.Global:
+			log.Printf("Maintenance window %d for the whole monitor scheduled from %s until %s; no notifications will be sent",
+				created.ID, created.Start.Format(time.RFC3339), created.End.Format(time.RFC3339))
+		default:
+			log.Printf("Maintenance window %d scheduled for %d hosts from %s until %s",
+				created.ID, len(hosts), created.Start.Format(time.RFC3339), created.End.Format(time.RFC3339))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			apiError(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		win, ok := maintenanceWindows[id]
+		if ok && win.Start.After(time.Now()) {
+			// Never started, so there is nothing to summarise
+			delete(maintenanceWindows, id)
+		} else if ok && win.End.After(time.Now()) {
+			// The summary follows the next round of checks as usual
+			win.End = time.Now()
+		}
+		mu.Unlock()
+		bumpVersion()
+		if !ok {
+			apiError(w, "Unknown maintenance window", http.StatusNotFound)
+			return
+		}
+		log.Printf("Maintenance window %d ended early", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// buildNotifiers creates the notifiers enabled by flags. Any number may be
+// enabled at once.
+func buildNotifiers() ([]Notifier, error) {
+	for name, delay := range map[string]time.Duration{"webhook": webhookAfter, "slack": slackAfter, "email": emailAfter, "pagerduty": pagerDutyAfter} {
+		if delay < 0 {
+			return nil, fmt.Errorf("-%s-after must not be negative", name)
+		} else if delay > 0 {
+			notifierDelays[name] = delay
+		}
+	}
+
+	switch unreachableNotify {
+	case "all":
+	case "none":
+		unreachableNotifiers = map[string]bool{}
+	default:
+		unreachableNotifiers = make(map[string]bool)
+		for _, name := range strings.Split(unreachableNotify, ",") {
+			name = strings.TrimSpace(name)
+			if name != "webhook" && name != "slack" && name != "email" && name != "pagerduty" {
+				return nil, fmt.Errorf("-unreachable-notify: unknown notifier %q", name)
+			}
+			unreachableNotifiers[name] = true
+		}
+	}
+
+	var enabled []Notifier
+	if webhookURL != "" {
+		n := &webhookNotifier{url: webhookURL, method: webhookMethod, header: webhookHeaders}
+		if webhookMethod != http.MethodPost && webhookMethod != http.MethodPut && webhookMethod != http.MethodPatch {
+			return nil, fmt.Errorf("-webhook-method must be POST, PUT or PATCH")
+		}
+		if webhookTemplate != "" {
+			tmpl, err := loadWebhookTemplate(webhookTemplate, n.contentType())
+			if err != nil {
+				return nil, fmt.Errorf("-webhook-template-file: %w", err)
+			}
+			n.tmpl = tmpl
+		}
+		enabled = append(enabled, n)
+	} else if webhookTemplate != "" {
+		return nil, fmt.Errorf("-webhook-template-file requires -webhook-url")
+	}
+	if slackWebhookURL != "" {
+		enabled = append(enabled, &slackNotifier{webhookURL: slackWebhookURL})
+	}
+	if pagerDutyKey != "" {
+		enabled = append(enabled, &pagerDutyNotifier{url: pagerDutyURL, routingKey: pagerDutyKey})
+	}
+	if emailTo != "" {
+		if smtpAddr == "" || emailFrom == "" {
+			return nil, fmt.Errorf("-email-to requires -smtp-addr and -email-from")
+		}
+		n := &emailNotifier{addr: smtpAddr, from: emailFrom}
+		for _, to := range strings.Split(emailTo, ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				n.to = append(n.to, to)
+			}
+		}
+		if smtpUser != "" {
+			smtpHost, _, _ := strings.Cut(smtpAddr, ":")
+			n.auth = smtp.PlainAuth("", smtpUser, smtpPassword, smtpHost)
+		}
+		enabled = append(enabled, n)
+	}
+	return enabled, nil
+}
+
+// postJSON sends payload as a JSON POST and treats any non-2xx reply as an error.
+func postJSON(target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookHeaders are the -webhook-header headers.
+var webhookHeaders = make(http.Header)
+
+// webhookNotifier sends each event to a URL, by default as a JSON POST of
+// the event itself. With -webhook-template-file the body is rendered from
+// the template instead, so it can take the shape a third-party API expects.
+type webhookNotifier struct {
+	url    string
+	method string
+	header http.Header
+	tmpl   *texttemplate.Template // nil sends the event as JSON
+}
+
+func (n *webhookNotifier) Name() string { return "webhook" }
+
+func (n *webhookNotifier) Notify(event TransitionEvent) error {
+	if n.tmpl == nil {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return n.send(body)
+	}
+	var body bytes.Buffer
+	if err := n.tmpl.Execute(&body, event); err != nil {
+		return err
+	}
+	return n.send(body.Bytes())
+}
+
+// webhookDigest is the JSON body of a webhook request carrying several
+// events. It is an object like a single event's, so receivers can tell the
+// two apart by the events field.
+type webhookDigest struct {
+	Title  string            `json:"title"`
+	Events []TransitionEvent `json:"events"`
+}
+
+// NotifyDigest sends the events as one webhookDigest, or when templated as
+// one request per event, as APIs with a payload shape of their own
+// generally take a single event per request.
+func (n *webhookNotifier) NotifyDigest(events []TransitionEvent) error {
+	if n.tmpl != nil {
+		var errs []error
+		for _, event := range events {
+			if err := n.Notify(event); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", event.Host, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+	body, err := json.Marshal(webhookDigest{Title: digestTitle(events), Events: events})
+	if err != nil {
+		return err
+	}
+	return n.send(body)
+}
+
+// contentType is the Content-Type of the webhook's requests: JSON unless
+// -webhook-header says otherwise.
+func (n *webhookNotifier) contentType() string {
+	if ct := n.header.Get("Content-Type"); ct != "" {
+		return ct
+	}
+	return "application/json"
+}
+
+// send makes one webhook request with body, treating any non-2xx reply as
+// an error.
+func (n *webhookNotifier) send(body []byte) error {
+	req, err := http.NewRequest(n.method, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range n.header {
+		req.Header[name] = values
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookTemplateFuncs are the functions available to -webhook-template-file.
+var webhookTemplateFuncs = texttemplate.FuncMap{
+	// json encodes a value, e.g. a string with its quotes and escapes
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// loadWebhookTemplate parses a webhook body template and tries it on a
+// sample event, so that mistakes such as unknown fields, or for a JSON
+// content type a body that isn't JSON, are found at startup rather than
+// at the first alert.
+func loadWebhookTemplate(path, contentType string) (*texttemplate.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := texttemplate.New(filepath.Base(path)).Funcs(webhookTemplateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	sample := TransitionEvent{
+		Host:      "https://example.com/health",
+		OldStatus: "UP",
+		NewStatus: "DOWN",
+		Timestamp: time.Now(),
+		LatencyMs: 12.5,
+		Error:     `unexpected status 503 "Service Unavailable"`,
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, sample); err != nil {
+		return nil, err
+	}
+	if strings.Contains(contentType, "json") && !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("rendering a sample event does not produce valid JSON:\n%s", body.String())
+	}
+	return tmpl, nil
+}
+
+// slackNotifier posts each event to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (n *slackNotifier) Name() string { return "slack" }
+
+func (n *slackNotifier) Notify(event TransitionEvent) error {
+	return postJSON(n.webhookURL, map[string]string{"text": slackLine(event)})
+}
+
+func (n *slackNotifier) NotifyDigest(events []TransitionEvent) error {
+	lines := []string{"*" + digestTitle(events) + ":*"}
+	for _, event := range events {
+		lines = append(lines, slackLine(event))
+	}
+	return postJSON(n.webhookURL, map[string]string{"text": strings.Join(lines, "\n")})
+}
+
+// slackLine formats an event as a single Slack message line.
+func slackLine(event TransitionEvent) string {
+	icon := ":white_check_mark:"
+	if !endsOutage(event.NewStatus) && event.NewStatus != sloOKStatus {
+		icon = ":red_circle:"
+	}
+	return icon + " " + event.Summary()
+}
+
+// pagerDutyNotifier sends events to the PagerDuty Events API v2. A failure
+// triggers an alert and the recovery resolves it; both carry a dedup key
+// derived from the host, so a flapping host stays one incident and
+// reminders don't open new ones. SLO burn alerts have a key of their own.
+type pagerDutyNotifier struct {
+	url        string
+	routingKey string
+}
+
+// pagerDutyEvent is the body of an Events API v2 request. Payload is only
+// sent with triggers.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Class         FailureReason     `json:"class,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+func (n *pagerDutyNotifier) Name() string { return "pagerduty" }
+
+func (n *pagerDutyNotifier) Notify(event TransitionEvent) error {
+	dedupKey := event.Host
+	if region != "" {
+		dedupKey += "@" + region
+	}
+	if event.NewStatus == sloBurningStatus || event.NewStatus == sloOKStatus {
+		dedupKey += " slo"
+	}
+	body := pagerDutyEvent{RoutingKey: n.routingKey, EventAction: "trigger", DedupKey: dedupKey}
+	if endsOutage(event.NewStatus) || event.NewStatus == sloOKStatus {
+		body.EventAction = "resolve"
+		return postJSON(n.url, body)
+	}
+
+	summary := event.Summary()
+	if len(summary) > 1024 {
+		summary = summary[:1024] // The API's limit
+	}
+	body.Payload = &pagerDutyPayload{
+		Summary:   summary,
+		Source:    event.Host,
+		Severity:  pagerDutySeverity(event),
+		Timestamp: event.Timestamp,
+		Class:     event.Reason,
+		CustomDetails: map[string]string{
+			"status":         event.NewStatus,
+			"previousStatus": event.OldStatus,
+			"latencyMs":      strconv.FormatFloat(event.LatencyMs, 'f', -1, 64),
+			"error":          event.Error,
+		},
+	}
+	if region != "" {
+		body.Payload.CustomDetails["region"] = region
+	}
+	return postJSON(n.url, body)
+}
+
+// pagerDutySeverity maps an event to a PagerDuty severity: warning for
+// degraded hosts and SLO burns, error for failures that point at the
+// host's configuration or content (UNREACHABLE hosts, TLS, login, redirect
+// and body mismatches), and critical for a host that can't be reached or
+// answers with an error status.
+func pagerDutySeverity(event TransitionEvent) string {
+	if event.NewStatus == sloBurningStatus || statusCategory(event.NewStatus) == "warn" {
+		return "warning"
+	}
+	if event.NewStatus == "UNREACHABLE" {
+		return "error"
+	}
+	switch event.Reason {
+	case ReasonTLS, ReasonAuth, ReasonRedirect, ReasonBody, ReasonInvalid, ReasonPanic:
+		return "error"
+	default:
+		return "critical"
+	}
+}
+
+// emailNotifier sends each event as a plain-text email over SMTP.
+type emailNotifier struct {
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+func (n *emailNotifier) Name() string { return "email" }
+
+func (n *emailNotifier) Notify(event TransitionEvent) error {
+	subject := fmt.Sprintf("[HostMonitor] %s is %s", event.Host, event.NewStatus)
+	return n.send(subject, emailBody(event))
+}
+
+func (n *emailNotifier) NotifyDigest(events []TransitionEvent) error {
+	subject := "[HostMonitor] " + digestTitle(events)
+	var body strings.Builder
+	for _, event := range events {
+		body.WriteString(emailBody(event) + "\r\n")
+	}
+	return n.send(subject, body.String())
+}
+
+// emailBody formats an event for a plain-text email.
+func emailBody(event TransitionEvent) string {
+	return fmt.Sprintf("%s\r\nTime: %s\r\nLatency: %.2fms\r\n",
+		event.Summary(), event.Timestamp.Format(time.RFC1123), event.LatencyMs)
+}
+
+// send delivers one email with the given subject and body.
+func (n *emailNotifier) send(subject, body string) error {
+	msg := "From: " + n.from + "\r\n" +
+		"To: " + strings.Join(n.to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(n.addr, n.auth, n.from, n.to, []byte(msg))
+}
+
+// stateFileVersion is bumped whenever the persisted layout of hostStats
+// changes incompatibly; files with another version are ignored.
+const stateFileVersion = 1
+
+// stateFile is the on-disk format written to -state-file.
+type stateFile struct {
+	Version int                   `json:"version"`
+	SavedAt time.Time             `json:"savedAt"`
+	Hosts   map[string]*hostStats `json:"hosts"`
+}
+
+// loadState restores stats from path for the hosts that are still being
+// monitored. A missing file is not an error.
+func loadState(path string, hosts []hostSpec) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if state.Version != stateFileVersion {
+		log.Printf("Ignoring state file %s: version %d, expected %d", path, state.Version, stateFileVersion)
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	restored := 0
+	for _, spec := range hosts {
+		if stats, ok := state.Hosts[spec.Host]; ok && stats != nil {
+			for i := range stats.Hourly {
+				stats.Hourly[i].fillUp()
+			}
+			hostStatsMap[spec.Host] = stats
+			restored++
+		}
+	}
+	log.Printf("Restored stats for %d hosts from %s (saved %s)", restored, path, state.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// saveState writes the stats for all local hosts to path. The file is
+// written to a temporary name and renamed so a crash can't leave it torn.
+func saveState(path string) error {
+	mu.RLock()
+	data, err := json.MarshalIndent(stateFile{
+		Version: stateFileVersion,
+		SavedAt: time.Now(),
+		Hosts:   hostStatsMap,
+	}, "", "  ")
+	mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// snapshotStatuses returns a copy of the local and federated statuses that
+// is safe to use after the lock is released.
+func snapshotStatuses() map[string]HostStatus {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	now := time.Now()
+	statuses := make(map[string]HostStatus, len(hostStatuses))
+	for key, status := range hostStatuses {
+		statuses[key] = prepareLocalStatus(status, now)
+	}
+	for _, peer := range peerStatuses {
+		for key, status := range peer {
+			statuses[key] = markStale(status, now)
+		}
+	}
+	for key, status := range leaderStatuses {
+		statuses[key] = markStale(status, now)
+	}
+	if hidePending {
+		for key, status := range statuses {
+			if statusCategory(status.Status) == "pending" {
+				delete(statuses, key)
+			}
+		}
+	}
+	return statuses
+}
+
+// localStatus returns the current status of a host monitored by this
+// instance, prepared the same way as in snapshotStatuses.
+func localStatus(host string) (HostStatus, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	status, ok := hostStatuses[host]
+	if !ok {
+		return HostStatus{}, false
+	}
+	return prepareLocalStatus(status, time.Now()), true
+}
+
+// prepareLocalStatus fills in the fields of a local host's status that are
+// derived when it is read rather than stored. mu must be held.
+func prepareLocalStatus(status HostStatus, now time.Time) HostStatus {
+	status.MaintenanceUntil = maintenanceUntil(status.Host, now)
+	if schedule := hostConfigs[status.Host].Options.Schedule; schedule != nil {
+		status.NotScheduled = !schedule.active(now)
+	}
+	if stats, ok := hostStatsMap[status.Host]; ok {
+		if includeHistory {
+			status.LatencyHistory = latencyHistory(stats.Recent)
+		}
+		status.LatencyTrend = latencyTrend(stats.Recent)
+		if status.SLOTarget > 0 {
+			status.ErrorBudgetRemaining = stats.errorBudgetRemaining(status.SLOTarget, now)
+		}
+	}
+	return markStale(status, now)
+}
+
+// The latency trend compares the average of the last trendCurrentChecks
+// checks that got a response with the moving average of the
+// trendBaselineChecks before them. A change of trendThreshold (a fraction
+// of the moving average) either way counts as a trend.
+const (
+	trendCurrentChecks  = 3
+	trendBaselineChecks = 20
+	trendThreshold      = 0.2
+)
+
+// latencyTrend returns "up" when the latest latencies are well above their
+// moving average, "down" when well below and "flat" otherwise, or "" when
+// there are not yet enough checks to compare.
+func latencyTrend(recent []checkSample) string {
+	// Newest first
+	var latencies []float64
+	for i := len(recent) - 1; i >= 0 && len(latencies) < trendCurrentChecks+trendBaselineChecks; i-- {
+		if category := statusCategory(recent[i].Status); category == "up" || category == "warn" {
+			latencies = append(latencies, recent[i].LatencyMs)
+		}
+	}
+	// A short baseline would make every blip a trend
+	if len(latencies) < trendCurrentChecks+trendBaselineChecks/2 {
+		return ""
+	}
+	mean := func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	}
+	current, baseline := mean(latencies[:trendCurrentChecks]), mean(latencies[trendCurrentChecks:])
+	switch {
+	case current > baseline*(1+trendThreshold):
+		return "up"
+	case current < baseline*(1-trendThreshold):
+		return "down"
+	}
+	return "flat"
+}
+
+// latencyHistorySize is how many recent latencies -include-history adds to
+// each status.
+const latencyHistorySize = 20
+
+// latencyHistory returns the latencies of the most recent checks, oldest
+// first.
+func latencyHistory(recent []checkSample) []float64 {
+	recent = recent[max(len(recent)-latencyHistorySize, 0):]
+	history := make([]float64, len(recent))
+	for i, sample := range recent {
+		history[i] = sample.LatencyMs
+	}
+	return history
+}
+
+// markStale flags a status whose last check is more than two intervals old,
+// which means its monitor (or the peer reporting it) has stopped updating.
+func markStale(status HostStatus, now time.Time) HostStatus {
+	if status.LastCheck.IsZero() || status.IntervalMs <= 0 {
+		return status
+	}
+	deadline := status.LastCheck.Add(2 * time.Duration(status.IntervalMs) * time.Millisecond)
+	if status.RetryAt != nil {
+		// A throttled host is deliberately checked late
+		deadline = deadline.Add(status.RetryAt.Sub(status.LastCheck))
+	}
+	if now.After(deadline) {
+		status.Stale = true
+	}
+	return status
+}
+
+// peer is a remote HostMonitor instance whose statuses are aggregated here.
+type peer struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// parsePeers parses the -peers flag. Each entry is "name=url" or a bare URL,
+// in which case the URL's host:port is used as the region name.
+func parsePeers(spec string) ([]peer, error) {
+	var peers []peer
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		p := peer{URL: entry}
+		if name, rawURL, ok := strings.Cut(entry, "="); ok && !strings.Contains(name, "/") {
+			p.Name, p.URL = strings.TrimSpace(name), strings.TrimSpace(rawURL)
+		}
+		u, err := url.Parse(p.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer URL %q", p.URL)
+		}
+		if p.Name == "" {
+			p.Name = u.Host
+		}
+		p.URL = strings.TrimRight(p.URL, "/")
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// pollPeer periodically pulls /api/status from a peer and merges the result
+// into peerStatuses. When the peer cannot be reached its last known data is
+// kept but marked stale.
+func pollPeer(p peer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Aggregating peer %s (%s) at %v intervals", p.Name, p.URL, interval)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	for ; ; <-ticker.C {
+		statuses, err := fetchPeerStatuses(client, p.URL+"/api/status")
+		if err != nil {
+			log.Printf("Peer %s unavailable: %v", p.Name, err)
+			mu.Lock()
+			for key, status := range peerStatuses[p.Name] {
+				status.Stale = true
+				peerStatuses[p.Name][key] = status
+			}
+			mu.Unlock()
+			bumpVersion()
+			continue
+		}
+
+		merged := make(map[string]HostStatus, len(statuses))
+		for _, status := range statuses {
+			// Keep the region reported by the peer if it has one (nested collectors)
+			if status.Region == "" {
+				status.Region = p.Name
+			}
+			merged[status.Host+"@"+status.Region] = status
+		}
+
+		mu.Lock()
+		peerStatuses[p.Name] = merged
+		mu.Unlock()
+		bumpVersion()
+	}
+}
+
+// promoted is set once a -follower has taken over from its leader.
+var promoted atomic.Bool
+
+// followLeader mirrors the leader's statuses every interval. Once the leader
+// has been unreachable for -failover-after, it drops the mirror and calls
+// promote, which starts this instance's own checks and so its alerts. A
+// follower that has taken over stays in charge until it is restarted, so
+// a flapping leader can't bounce the role back and forth.
+func followLeader(ctx context.Context, leader string, interval time.Duration, promote func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Following leader %s; taking over if it is unreachable for %v", leader, failoverAfter)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	lastContact := time.Now()
+	reachable := true
+	for {
+		statuses, err := fetchPeerStatuses(client, strings.TrimSuffix(leader, "/")+"/api/status")
+		switch {
+		case err == nil:
+			if !reachable {
+				log.Printf("Leader %s is reachable again", leader)
+				reachable = true
+			}
+			lastContact = time.Now()
+			mu.Lock()
+			leaderStatuses = statuses
+			mu.Unlock()
+		case time.Since(lastContact) >= failoverAfter:
+			log.Printf("Leader %s unreachable for %v (%v); taking over checks and alerts",
+				leader, time.Since(lastContact).Round(time.Second), err)
+			mu.Lock()
+			leaderStatuses = nil
+			mu.Unlock()
+			promoted.Store(true)
+			promote()
+			bumpVersion()
+			return
+		default:
+			if reachable {
+				log.Printf("Leader %s unavailable: %v", leader, err)
+				reachable = false
+			}
+			mu.Lock()
+			for key, status := range leaderStatuses {
+				status.Stale = true
+				leaderStatuses[key] = status
+			}
+			mu.Unlock()
+		}
+		bumpVersion()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchPeerStatuses retrieves and decodes a peer's /api/status response.
+// It asks for the bare map of statuses, which is what peers from before
+// the envelope send regardless.
+func fetchPeerStatuses(client *http.Client, statusURL string) (map[string]HostStatus, error) {
+	resp, err := client.Get(statusURL + "?envelope=0")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var statuses map[string]HostStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return statuses, nil
+}
+
+// statusEnvelope wraps the statuses served by /api/status and /events with
+// the server's time and the summary counts. Hosts is an object keyed by
+// host, or an array with ?sort.
+type statusEnvelope = api.Envelope[any]
+
+// wantsEnvelope reports whether a status request should get a
+// statusEnvelope. Clients written before it was introduced, which expect
+// the bare statuses, can ask for them with ?envelope=0.
+func wantsEnvelope(r *http.Request) bool {
+	return r.URL.Query().Get("envelope") != "0"
+}
+
+// apiError replies to an /api/* request with an error as JSON, in the
+// envelope {"error": message, "code": code}, so that clients can decode
+// failures like every other response. It is used as http.Error is.
+func apiError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(api.Error{Message: message, Code: code}); err != nil {
+		log.Printf("Error encoding error JSON: %v", err)
+	}
+}
+
+// apiNotFoundHandler answers requests for /api/* paths that no endpoint
+// serves, which would otherwise reach the dashboard's catch-all.
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	apiError(w, "Not found", http.StatusNotFound)
+}
+
+// apiStatusHandler returns the current statuses as JSON in a
+// statusEnvelope, with the statuses as an object keyed by host by default.
+// ?sort=latency|host|status returns them as an array in that order instead,
+// and ?fields=a,b keeps only the named fields of each status.
+func apiStatusHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sortBy := query.Get("sort")
+	if sortBy != "" && sortBy != "latency" && sortBy != "host" && sortBy != "status" {
+		apiError(w, "Invalid sort: must be latency, host or status", http.StatusBadRequest)
+		return
+	}
+	var fields []string
+	if query.Get("fields") != "" {
+		for _, field := range strings.Split(query.Get("fields"), ",") {
+			field = strings.TrimSpace(field)
+			if !slices.Contains(statusFields, field) {
+				apiError(w, "Unknown field: "+field, http.StatusBadRequest)
+				return
+			}
+			fields = append(fields, field)
+		}
+	}
+
+	// The snapshot is a copy taken under the lock, so it can be sorted and
+	// projected without holding up the monitors
+	statuses := snapshotStatuses()
+
+	var payload any = statuses
+	if sortBy != "" {
+		sorted := sortStatuses(statuses, sortBy)
+		if fields != nil {
+			projected := make([]map[string]json.RawMessage, len(sorted))
+			for i, status := range sorted {
+				projected[i] = projectStatus(status, fields)
+			}
+			payload = projected
+		} else {
+			payload = sorted
+		}
+	} else if fields != nil {
+		projected := make(map[string]map[string]json.RawMessage, len(statuses))
+		for key, status := range statuses {
+			projected[key] = projectStatus(status, fields)
+		}
+		payload = projected
+	}
+	if wantsEnvelope(r) {
+		now := time.Now()
+		payload = statusEnvelope{ServerTime: now, Hosts: payload, Summary: summarize(statuses), MaintenanceUntil: globalMaintenanceUntil(now)}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Server-Timing", serverTiming(statuses))
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("Error encoding status JSON: %v", err)
+	}
+}
+
+// statusFields lists the JSON field names of HostStatus, for validating
+// ?fields=.
+var statusFields = func() []string {
+	var names []string
+	t := reflect.TypeOf(HostStatus{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}()
+
+// sortStatuses returns the statuses ordered by sortBy: "latency" fastest
+// first, "host" by key, or "status" worst first (down, warn, pending, up).
+// Ties are broken by key so the order is stable between requests.
+func sortStatuses(statuses map[string]HostStatus, sortBy string) []HostStatus {
+	keys := make([]string, 0, len(statuses))
+	for key := range statuses {
+		keys = append(keys, key)
+	}
+	severity := map[string]int{"down": 0, "warn": 1, "pending": 2, "expected": 3, "up": 4}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := statuses[keys[i]], statuses[keys[j]]
+		switch sortBy {
+		case "latency":
+			if a.LatencyMs != b.LatencyMs {
+				return a.LatencyMs < b.LatencyMs
+			}
+		case "status":
+			if sa, sb := severity[statusCategory(a.Status)], severity[statusCategory(b.Status)]; sa != sb {
+				return sa < sb
+			}
+		}
+		return keys[i] < keys[j]
+	})
+
+	sorted := make([]HostStatus, len(keys))
+	for i, key := range keys {
+		sorted[i] = statuses[key]
+	}
+	return sorted
+}
+
+// projectStatus returns only the named fields of a status. Fields left out
+// of the status's JSON by omitempty stay out.
+func projectStatus(status HostStatus, fields []string) map[string]json.RawMessage {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return nil
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil
+	}
+	projected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+// statusSummary counts hosts by category. Every host falls in exactly one
+// category, so Up+Warn+Down+Pending always equals Total.
+type statusSummary = api.Summary
+
+// statusCategory maps a host status to its summary category: "up", "warn"
+// (which includes THROTTLED), "pending" for hosts awaiting their first
+// check, and "down" for everything else. Peers running an older version
+// report pending hosts as INIT. The dashboard's renderDashboard mirrors
+// this rule.
+func statusCategory(status string) string {
+	switch status {
+	case "UP":
+		return "up"
+	case "WARN", "THROTTLED":
+		return "warn"
+	case "PENDING", "INIT":
+		return "pending"
+	case expectedDownStatus:
+		return "expected"
+	default:
+		return "down"
+	}
+}
+
+// expectedDownStatus is the status of a host that failed its check outside
+// its expected_up window, e.g. a batch host that only runs during the day.
+// It is not an outage: it raises no alert and is left out of the uptime.
+const expectedDownStatus = "EXPECTED_DOWN"
+
+// endsOutage reports whether a host changing to status ends its outage, if
+// it has one: it is UP again, or has failed out of its expected_up window.
+func endsOutage(status string) bool {
+	return status == "UP" || status == expectedDownStatus
+}
+
+// summarize counts statuses by category.
+func summarize(statuses map[string]HostStatus) statusSummary {
+	summary := statusSummary{Total: len(statuses)}
+	for _, status := range statuses {
+		switch statusCategory(status.Status) {
+		case "up":
+			summary.Up++
+		case "warn":
+			summary.Warn++
+		case "pending":
+			summary.Pending++
+		case "expected":
+			summary.ExpectedDown++
+		default:
+			summary.Down++
+		}
+	}
+	return summary
+}
+
+// apiSummaryHandler returns the host counts by category as JSON.
+func apiSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summarize(snapshotStatuses())); err != nil {
+		log.Printf("Error encoding summary JSON: %v", err)
+	}
+}
+
+// healthReport is the overall health served by /healthz.
+type healthReport struct {
+	Healthy           bool     `json:"healthy"`
+	DownWeightPercent float64  `json:"downWeightPercent"` // Weighted share of hosts that are DOWN
+	Threshold         float64  `json:"threshold"`         // -health-threshold
+	CriticalDown      []string `json:"criticalDown"`      // Critical hosts that are DOWN
+}
+
+// overallHealth weighs up the statuses: unhealthy when any critical host is
+// DOWN, or the hosts that are DOWN carry at least -health-threshold percent
+// of the total weight. Hosts in maintenance don't count.
+func overallHealth(statuses map[string]HostStatus) healthReport {
+	report := healthReport{Threshold: healthThreshold, CriticalDown: []string{}}
+	var total, down float64
+	for key, status := range statuses {
+		if status.MaintenanceUntil != nil {
+			continue
+		}
+		weight := 1.0
+		if status.Weight != nil {
+			weight = *status.Weight
+		}
+		total += weight
+		if statusCategory(status.Status) != "down" {
+			continue
+		}
+		down += weight
+		if status.Critical {
+			report.CriticalDown = append(report.CriticalDown, key)
+		}
+	}
+	sort.Strings(report.CriticalDown)
+	if total > 0 {
+		report.DownWeightPercent = float64(int(down/total*1000)) / 10.0 // Round to 1 decimal
+	}
+	report.Healthy = len(report.CriticalDown) == 0 && (total == 0 || down/total*100 < healthThreshold)
+	return report
+}
+
+// healthzHandler reports the overall health as JSON, with a 503 status when
+// unhealthy so load balancers and probes can act on it directly.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	report := overallHealth(snapshotStatuses())
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Error encoding health JSON: %v", err)
+	}
+}
+
+// diffState is a host's state at one end of a /api/diff range.
+type diffState struct {
+	Status    string     `json:"status,omitempty"`    // Empty when the history doesn't reach back that far
+	Since     *time.Time `json:"since,omitempty"`     // When the host took on Status
+	LatencyMs *float64   `json:"latencyMs,omitempty"` // From the last check, while it is among the recent ones
+}
+
+// hostDiff describes how a host's status changed within a /api/diff range.
+type hostDiff struct {
+	Host        string    `json:"host"`
+	Before      diffState `json:"before"`
+	After       diffState `json:"after"`
+	Changes     int       `json:"changes"`     // Status changes within the range
+	FirstChange time.Time `json:"firstChange"` // Earliest of them
+}
+
+// stateAt returns the host's state at t from its change log and recent
+// checks.
+func (s *hostStats) stateAt(t time.Time) diffState {
+	var state diffState
+	// The last change at or before t
+	i := sort.Search(len(s.Changes), func(i int) bool { return s.Changes[i].Time.After(t) }) - 1
+	if i < 0 {
+		return state
+	}
+	state.Status = s.Changes[i].Status
+	since := s.Changes[i].Time
+	state.Since = &since
+
+	if j := sort.Search(len(s.Recent), func(j int) bool { return s.Recent[j].Time.After(t) }) - 1; j >= 0 {
+		latency := s.Recent[j].LatencyMs
+		state.LatencyMs = &latency
+	}
+	return state
+}
+
+// apiDiffHandler lists the local hosts whose status changed between the
+// RFC 3339 times from and to (default now), with their states at both, for
+// working out what went wrong together during an incident. Hosts are
+// ordered by their first change. It reaches back as far as each host's
+// change log, which -state-file keeps across restarts.
+func apiDiffHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		apiError(w, "Invalid from: must be an RFC 3339 time, e.g. 2024-05-01T10:00:00Z", http.StatusBadRequest)
+		return
+	}
+	to := time.Now()
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			apiError(w, "Invalid to: must be an RFC 3339 time, e.g. 2024-05-01T10:05:00Z", http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		apiError(w, "Invalid range: from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	diffs := []hostDiff{}
+	mu.RLock()
+	for host, stats := range hostStatsMap {
+		diff := hostDiff{Host: host}
+		for _, change := range stats.Changes {
+			if change.Time.After(from) && !change.Time.After(to) {
+				if diff.Changes == 0 {
+					diff.FirstChange = change.Time
+				}
+				diff.Changes++
+			}
+		}
+		if diff.Changes == 0 {
+			continue
+		}
+		diff.Before = stats.stateAt(from)
+		diff.After = stats.stateAt(to)
+		diffs = append(diffs, diff)
+	}
+	mu.RUnlock()
+	sort.Slice(diffs, func(i, j int) bool {
+		if !diffs[i].FirstChange.Equal(diffs[j].FirstChange) {
+			return diffs[i].FirstChange.Before(diffs[j].FirstChange)
+		}
+		return diffs[i].Host < diffs[j].Host
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		From  time.Time  `json:"from"`
+		To    time.Time  `json:"to"`
+		Hosts []hostDiff `json:"hosts"`
+	}{from, to, diffs})
+	if err != nil {
+		log.Printf("Error encoding diff JSON: %v", err)
+	}
+}
+
+// serverTiming summarizes aggregate check health as a Server-Timing header
+// value: how many hosts are up, and the average and worst latency among them.
+func serverTiming(statuses map[string]HostStatus) string {
+	up := 0
+	var total, worst float64
+	for _, status := range statuses {
+		if status.Status != "UP" {
+			continue
+		}
+		up++
+		total += status.LatencyMs
+		worst = math.Max(worst, status.LatencyMs)
+	}
+
+	avg := 0.0
+	if up > 0 {
+		avg = total / float64(up)
+	}
+	return fmt.Sprintf(`hosts-up;desc="%d/%d", latency-avg;dur=%.2f, latency-max;dur=%.2f`, up, len(statuses), avg, worst)
+}
+
+// effectiveConfig is the running configuration reported by /api/config.
+type effectiveConfig struct {
+	Port                int              `json:"port"`
+	Bind                string           `json:"bind,omitempty"`
+	UnixSocket          string           `json:"unixSocket,omitempty"`
+	Region              string           `json:"region,omitempty"`
+	Check               string           `json:"check"`
+	Method              string           `json:"method"`
+	TimeoutMs           int              `json:"timeoutMs"`
+	StepTimeoutMs       int              `json:"stepTimeoutMs,omitempty"`
+	DefaultIntervalMs   int              `json:"defaultIntervalMs"`
+	FollowRedirects     bool             `json:"followRedirects"`
+	MaxRedirects        int              `json:"maxRedirects,omitempty"`
+	DisableCompression  bool             `json:"disableCompression,omitempty"`
+	DualStack           bool             `json:"dualStack,omitempty"`
+	ExpectRedirect      string           `json:"expectRedirect,omitempty"`
+	ExpectJSON          string           `json:"expectJson,omitempty"`
+	MinTLS              string           `json:"minTls,omitempty"`
+	TLSWarn             bool             `json:"tlsWarn"`
+	PingCount           int              `json:"pingCount,omitempty"`
+	PingSize            int              `json:"pingSize,omitempty"`
+	WarnLoss            float64          `json:"warnLoss,omitempty"`
+	DownLoss            float64          `json:"downLoss,omitempty"`
+	LatencyWarnMs       float64          `json:"latencyWarnMs"`
+	HealthThreshold     float64          `json:"healthThreshold"`
+	HidePending         bool             `json:"hidePending"`
+	LatencyCritMs       float64          `json:"latencyCritMs"`
+	WarnOn              []FailureReason  `json:"warnOn"`
+	RateLimit           float64          `json:"rateLimit"`
+	JitterPercent       float64          `json:"jitterPercent"`
+	Workers             int              `json:"workers"`
+	AlertGroupWindow    string           `json:"alertGroupWindow"`
+	AlertRepeatInterval string           `json:"alertRepeatInterval"`
+	IncidentWindow      string           `json:"incidentWindow"`
+	IncidentMinHosts    int              `json:"incidentMinHosts"`
+	QuietHours          string           `json:"quietHours,omitempty"`
+	StateFile           string           `json:"stateFile,omitempty"`
+	SOCKS5              string           `json:"socks5,omitempty"`
+	Resolver            string           `json:"resolver,omitempty"`
+	Hosts               []configHost     `json:"hosts"`
+	Peers               []peer           `json:"peers"`
+	LeaderURL           string           `json:"leaderUrl,omitempty"` // Set while a -follower
+	Promoted            bool             `json:"promoted,omitempty"`  // A -follower that has taken over
+	Notifiers           []configNotifier `json:"notifiers"`
+}
+
+// configHost describes how one local host is being checked.
+type configHost struct {
+	Host       string  `json:"host"`
+	Check      string  `json:"check"`
+	IntervalMs int     `json:"intervalMs"`
+	Target     string  `json:"target"`
+	Name       string  `json:"name,omitempty"`
+	SLOMs      float64 `json:"sloMs,omitempty"`
+	SLOTarget  float64 `json:"sloTarget,omitempty"`
+	SourceIP   string  `json:"sourceIp,omitempty"`
+	Login      string  `json:"login,omitempty"` // Login URL; the body stays private
+	ClientCert string  `json:"clientCert,omitempty"`
+	Schedule   string  `json:"schedule,omitempty"`
+	Critical   bool    `json:"critical,omitempty"`
+	Weight     float64 `json:"weight,omitempty"`
+	QuietHours string  `json:"quietHours,omitempty"`
+	ExpectedUp string  `json:"expectedUp,omitempty"`
+	Group      string  `json:"group,omitempty"`
+	SNI        string  `json:"sni,omitempty"`
+	Proto      string  `json:"proto,omitempty"`
+	PingSize   int     `json:"pingSize,omitempty"`
+	Proxy      string  `json:"proxy,omitempty"` // Host only; the credentials stay private
+}
+
+// configNotifier describes an enabled notifier without its secrets.
+type configNotifier struct {
+	Name        string `json:"name"`
+	Target      string `json:"target"`
+	After       string `json:"after,omitempty"`
+	Unreachable bool   `json:"unreachable"` // Whether it is alerted about UNREACHABLE hosts
+}
+
+// configuredPeers are the peers parsed from -peers, kept for /api/config.
+var configuredPeers []peer
+
+// apiConfigHandler returns the effective configuration as JSON.
+func apiConfigHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := effectiveConfig{
+		Port:                port,
+		Bind:                bindAddr,
+		UnixSocket:          unixSocket,
+		Region:              region,
+		Check:               checkType,
+		Method:              checkMethod,
+		TimeoutMs:           timeoutMs,
+		StepTimeoutMs:       stepTimeoutMs,
+		DefaultIntervalMs:   intervalMs,
+		FollowRedirects:     followRedirects && expectRedirect == "",
+		MaxRedirects:        maxRedirects,
+		DisableCompression:  disableCompression,
+		DualStack:           dualStack,
+		ExpectRedirect:      expectRedirect,
+		ExpectJSON:          expectJSON,
+		MinTLS:              minTLS,
+		TLSWarn:             tlsWarn,
+		LatencyWarnMs:       latencyWarnMs,
+		HealthThreshold:     healthThreshold,
+		HidePending:         hidePending,
+		LatencyCritMs:       latencyCritMs,
+		WarnOn:              []FailureReason{},
+		RateLimit:           rateLimit,
+		JitterPercent:       jitterPercent,
+		Workers:             workers,
+		AlertGroupWindow:    alertGroupWindow.String(),
+		AlertRepeatInterval: alertRepeatInterval.String(),
+		IncidentWindow:      incidentWindow.String(),
+		IncidentMinHosts:    incidentMinHosts,
+		QuietHours:          globalQuietHours.String(),
+		StateFile:           stateFilePath,
+		Hosts:               []configHost{},
+		Peers:               []peer{},
+		Notifiers:           []configNotifier{},
+	}
+	if follower {
+		cfg.Promoted = promoted.Load()
+		if !cfg.Promoted {
+			cfg.LeaderURL = leaderURL
+		}
+	}
+
+	mu.RLock()
+	for host, status := range hostStatuses {
+		cfg.Hosts = append(cfg.Hosts, configHost{
+			Host:       host,
+			Check:      checkType,
+			IntervalMs: status.IntervalMs,
+			Target:     hostConfigs[host].Target,
+			Name:       hostConfigs[host].Options.Name,
+			SLOMs:      hostConfigs[host].Options.SLOMs,
+			SLOTarget:  status.SLOTarget,
+			SourceIP:   sourceString(hostConfigs[host].Options.source()),
+			Login:      hostConfigs[host].Options.LoginURL,
+			ClientCert: clientCertPath(hostConfigs[host].Options),
+			Schedule:   hostConfigs[host].Options.Schedule.String(),
+			Critical:   hostConfigs[host].Options.Critical,
+			Weight:     hostConfigs[host].Options.Weight,
+			QuietHours: hostConfigs[host].Options.quietHours().String(),
+			ExpectedUp: hostConfigs[host].Options.ExpectedUp.String(),
+			Group:      hostConfigs[host].Options.Group,
+			SNI:        hostConfigs[host].Options.SNI,
+			Proto:      hostConfigs[host].Options.Proto,
+			PingSize:   status.PingSize,
+			Proxy:      proxyHost(hostConfigs[host].Options.Proxy),
+		})
+	}
+	mu.RUnlock()
+	sort.Slice(cfg.Hosts, func(i, j int) bool { return cfg.Hosts[i].Host < cfg.Hosts[j].Host })
+
+	if checkType == "icmp" {
+		cfg.PingCount = pingCount
+		cfg.PingSize = pingSize
+		cfg.WarnLoss = warnLoss
+		cfg.DownLoss = downLoss
+	}
+
+	if socks5Proxy != nil {
+		// Host only; the proxy credentials stay private
+		cfg.SOCKS5 = socks5Proxy.Host
+	}
+	cfg.Resolver = resolverAddr
+	for _, reason := range failureReasons {
+		if warnReasons[reason] {
+			cfg.WarnOn = append(cfg.WarnOn, reason)
+		}
+	}
+	for _, p := range configuredPeers {
+		cfg.Peers = append(cfg.Peers, peer{Name: p.Name, URL: redactURL(p.URL)})
+	}
+	for _, n := range notifiers {
+		cfg.Notifiers = append(cfg.Notifiers, describeNotifier(n))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		log.Printf("Error encoding config JSON: %v", err)
+	}
+}
+
+// describeNotifier summarizes a notifier's destination with secrets removed.
+func describeNotifier(n Notifier) configNotifier {
+	desc := configNotifier{Name: n.Name(), Unreachable: notifiesUnreachable(n)}
+	if delay := notifierDelays[n.Name()]; delay > 0 {
+		desc.After = delay.String()
+	}
+	switch n := n.(type) {
+	case *webhookNotifier:
+		desc.Target = redactURL(n.url)
+	case *slackNotifier:
+		desc.Target = redactURL(n.webhookURL)
+	case *pagerDutyNotifier:
+		desc.Target = redactURL(n.url)
+	case *emailNotifier:
+		desc.Target = strings.Join(n.to, ", ") + " via " + n.addr
+	}
+	return desc
+}
+
+// redactURL keeps only the scheme and host of a URL. Paths and query strings
+// are dropped along with credentials because webhook URLs (Slack's in
+// particular) carry their secret token in the path.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "[redacted]"
+	}
+	redacted := u.Scheme + "://" + u.Host
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		redacted += "/[redacted]"
+	}
+	return redacted
+}
+
+// hostActions maps the final path segment of /api/hosts/{host}/{action} to
+// its handler.
+var hostActions = map[string]func(w http.ResponseWriter, r *http.Request, host string){
+	"latency": hostLatencyHandler,
+	"check":   hostCheckHandler,
+	"trend":   hostTrendHandler,
+	"history": hostHistoryHandler,
+	"ack":     hostAckHandler,
+	"reset":   hostResetHandler,
+}
+
+// hostsAPIHandler routes /api/hosts/{host}/{action} requests, and requests
+// for /api/hosts/{host} itself. The host is everything between the prefix and
+// the action, path-unescaped, so URL hosts can be given either escaped (%2F)
+// or with their slashes intact.
+func hostsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/api/hosts/")
+	if rest == "" {
+		apiError(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	handler := hostResourceHandler
+	if idx := strings.LastIndex(rest, "/"); idx > 0 {
+		if action, ok := hostActions[rest[idx+1:]]; ok {
+			handler, rest = action, rest[:idx]
+		}
+	}
+	host, err := url.PathUnescape(rest)
+	if err != nil {
+		apiError(w, "Invalid host", http.StatusBadRequest)
+		return
+	}
+	handler(w, r, host)
+}
+
+// minIntervalMs is the shortest check interval that can be set at runtime.
+const minIntervalMs = 100
+
+// hostPatch is the body of a PATCH to /api/hosts/{host}. Fields left out are
+// unchanged.
+type hostPatch struct {
+	IntervalMs *int `json:"intervalMs"`
+}
+
+// hostResourceHandler returns a local host's status (GET) or changes its
+// settings while it is being monitored (PATCH).
+func hostResourceHandler(w http.ResponseWriter, r *http.Request, host string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPatch:
+		var patch hostPatch
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBodyBytes)).Decode(&patch); err != nil {
+			apiError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if patch.IntervalMs != nil {
+			mu.RLock()
+			scheduled := hostConfigs[host].Options.Schedule != nil
+			mu.RUnlock()
+			if scheduled {
+				apiError(w, "Host is checked on a cron schedule, not an interval", http.StatusConflict)
+				return
+			}
+			if *patch.IntervalMs < minIntervalMs {
+				apiError(w, fmt.Sprintf("Invalid intervalMs: must be at least %d", minIntervalMs), http.StatusBadRequest)
+				return
+			}
+			interval := time.Duration(*patch.IntervalMs) * time.Millisecond
+			if err := setCheckInterval(host, interval); err != nil {
+				apiError(w, "Unknown host", http.StatusNotFound)
+				return
+			}
+			mu.Lock()
+			if status, ok := hostStatuses[host]; ok {
+				status.IntervalMs = *patch.IntervalMs
+				hostStatuses[host] = status
+			}
+			mu.Unlock()
+			bumpVersion()
+			log.Printf("Check interval for %s changed to %v", host, interval)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PATCH")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, ok := localStatus(host)
+	if !ok {
+		apiError(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Error encoding status JSON: %v", err)
+	}
+}
+
+// hostLatencyHandler returns a host's current latency in milliseconds as
+// plain text, for easy scraping from shell scripts.
+func hostLatencyHandler(w http.ResponseWriter, r *http.Request, host string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, ok := snapshotStatuses()[host]
+	if !ok {
+		apiError(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%.2f\n", status.LatencyMs)
+}
+
+// hostTrendHandler returns a host's hourly latency summaries as JSON, oldest
+// first and ending with the hour in progress, for charting slow drifts in
+// response time. ?hours=N returns only the most recent N hours.
+func hostTrendHandler(w http.ResponseWriter, r *http.Request, host string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := hourlyLogSize + 1
+	if s := r.URL.Query().Get("hours"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			apiError(w, "Invalid hours: must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	mu.RLock()
+	stats, ok := hostStatsMap[host]
+	var hours []rollup
+	if ok {
+		hours = slices.Clone(stats.Hourly)
+		if stats.hour.checks > 0 {
+			current := stats.hour.summary()
+			current.Partial = true
+			hours = append(hours, current)
+		}
+	}
+	mu.RUnlock()
+	if !ok {
+		apiError(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+	if len(hours) > limit {
+		hours = hours[len(hours)-limit:]
+	}
+	if hours == nil {
+		hours = []rollup{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"host": host, "hours": hours}); err != nil {
+		log.Printf("Error encoding trend JSON: %v", err)
+	}
+}
+
+// hostHistoryHandler returns a host's most recent checks as JSON, oldest
+// first, for the dashboard's latency chart. ?checks=N returns only the most
+// recent N.
+//
+// ?range=D (a duration such as 6h) returns the history of the last D at the
+// finest resolution kept for all of it: the checks themselves within
+// rawHistoryAge, then per-minute rollups within minuteHistoryAge, then
+// per-hour ones. The last rollup is the period in progress.
+func hostHistoryHandler(w http.ResponseWriter, r *http.Request, host string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := recentChecksSize
+	if s := query.Get("checks"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			apiError(w, "Invalid checks: must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var span time.Duration
+	if s := query.Get("range"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			apiError(w, "Invalid range: must be a positive duration, e.g. 6h", http.StatusBadRequest)
+			return
+		}
+		if query.Get("checks") == "" {
+			limit = math.MaxInt
+		}
+		span = d
+	}
+	since := time.Now().Add(-span)
+
+	mu.RLock()
+	stats, ok := hostStatsMap[host]
+	var checks []checkSample
+	var periods []rollup
+	var period time.Duration
+	resolution := "check"
+	if ok {
+		switch {
+		case span <= rawHistoryAge:
+			checks = slices.Clone(stats.Recent)
+		case span <= minuteHistoryAge:
+			resolution, period = "minute", time.Minute
+			periods = append(slices.Clone(stats.Minutes), rollUp(stats.Recent, time.Minute)...)
+		default:
+			resolution, period = "hour", time.Hour
+			periods = slices.Clone(stats.Hourly)
+			if stats.hour.checks > 0 {
+				periods = append(periods, stats.hour.summary())
+			}
+		}
+	}
+	mu.RUnlock()
+	if !ok {
+		apiError(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]any{"host": host, "resolution": resolution}
+	if resolution == "check" {
+		if span > 0 {
+			first := sort.Search(len(checks), func(i int) bool { return !checks[i].Time.Before(since) })
+			checks = checks[first:]
+		}
+		if len(checks) > limit {
+			checks = checks[len(checks)-limit:]
+		}
+		if checks == nil {
+			checks = []checkSample{}
+		}
+		response["checks"] = checks
+	} else {
+		// A period counts if any of it is within the range
+		first := sort.Search(len(periods), func(i int) bool { return periods[i].Start.Add(period).After(since) })
+		periods = periods[first:]
+		if n := len(periods); n > 0 && time.Since(periods[n-1].Start) < period {
+			periods[n-1].Partial = true
+		}
+		if periods == nil {
+			periods = []rollup{}
+		}
+		response["rollups"] = periods
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding history JSON: %v", err)
+	}
+}
+
+// hostAckHandler acknowledges a failing host's current outage, so someone
+// working on it is not sent reminders or escalations; the recovery alert is
+// still sent. It returns the host's status as JSON.
+func hostAckHandler(w http.ResponseWriter, r *http.Request, host string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mu.Lock()
+	status, ok := hostStatuses[host]
+	if !ok {
+		mu.Unlock()
+		apiError(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+	if status.Status == "UP" || status.Status == "PENDING" {
+		mu.Unlock()
+		apiError(w, "Host is "+status.Status+", so there is no outage to acknowledge", http.StatusConflict)
+		return
+	}
+	if status.AckedAt == nil {
+		now := time.Now()
+		status.AckedAt = &now
+		hostStatuses[host] = status
+		log.Printf("Outage of %s acknowledged from %s", host, r.RemoteAddr)
+	}
+	mu.Unlock()
+	bumpVersion()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Error encoding status JSON: %v", err)
+	}
+}
+
+// hostResetHandler clears a host's statistics, e.g. once a flaky host has
+// been fixed and its history no longer says anything about it: the check
+// count, recent checks, rollups, outage and change logs, SLO window and
+// traffic counters start over, and the host stays monitored. Its current
+// status, when it was last UP and whether it ever was are kept. It returns
+// the host's status as JSON.
+func hostResetHandler(w http.ResponseWriter, r *http.Request, host string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mu.Lock()
+	status, ok := hostStatuses[host]
+	if !ok {
+		mu.Unlock()
+		apiError(w, "Unknown host", http.StatusNotFound)
+		return
+	}
+	stats := &hostStats{LastSuccess: status.LastSuccess}
+	hostStatsMap[host] = stats
+	status.CheckCount = 0
+	status.UptimePercent = stats.uptimePercent()
+	status.MTBF, status.MTTR = stats.reliability()
+	status.SLOBreaches, status.SLOBreachPercent = 0, 0
+	hostStatuses[host] = status
+	status = prepareLocalStatus(status, time.Now())
+	mu.Unlock()
+	bumpVersion()
+	log.Printf("Statistics of %s reset from %s", host, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Error encoding status JSON: %v", err)
+	}
+}
+
+// hostCheckHandler runs an immediate check of a host and returns its fresh
+// status as JSON.
+func hostCheckHandler(w http.ResponseWriter, r *http.Request, host string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := triggerCheck(r.Context(), host)
+	if errors.Is(err, errUnknownHost) {
+		apiError(w, "Unknown host", http.StatusNotFound)
+		return
+	} else if err != nil {
+		// The client went away or the server is shutting down
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Error encoding status JSON: %v", err)
+	}
+}
+
+// SSE stream tuning: the reconnect delay suggested to browsers, and how
+// often unchanged data is re-sent anyway.
+const (
+	sseRetryMs        = 3000
+	sseResyncInterval = 5 * time.Second
+	// sseFullResyncInterval is how often a delta stream resends every host,
+	// so a client that missed or misapplied a delta converges again.
+	sseFullResyncInterval = time.Minute
+)
+
+// sseDelta is the payload of a delta-encoded /events stream (?delta=1).
+// Full events carry every host and replace the client's state; the others
+// carry only the hosts that changed since the previous event and the keys
+// of hosts that have gone away.
+type sseDelta = api.Delta
+
+// deltaChanged reports whether a host's status differs enough from what was
+// last sent to go in a delta. The per-check bookkeeping fields are ignored
+// so hosts whose status and latency are steady stay out; full resyncs
+// bring them up to date.
+func deltaChanged(prev, cur HostStatus) bool {
+	prev.LastCheck, cur.LastCheck = time.Time{}, time.Time{}
+	prev.CheckCount, cur.CheckCount = 0, 0
+	a, errA := json.Marshal(prev)
+	b, errB := json.Marshal(cur)
+	return errA != nil || errB != nil || !bytes.Equal(a, b)
+}
+
+// statusVersion is incremented whenever any status changes. Together with
+// the process start time it forms the SSE event id, so an id from before a
+// restart never matches.
+var statusVersion atomic.Uint64
+
+// bumpVersion records that the statuses changed.
+func bumpVersion() {
+	statusVersion.Add(1)
+}
+
+// currentEventID returns the SSE id describing the current statuses.
+func currentEventID() string {
+	return fmt.Sprintf("%d-%d", processStart.UnixNano(), statusVersion.Load())
+}
+
+// sseClients counts the currently connected SSE clients.
+var sseClients atomic.Int64
+
+// debugStats is the self-monitoring payload served at /debug/stats.
+type debugStats struct {
+	Goroutines     int    `json:"goroutines"`
+	SSEClients     int64  `json:"sseClients"`
+	Hosts          int    `json:"hosts"`
+	PeerHosts      int    `json:"peerHosts"`
+	HeapAllocBytes uint64 `json:"heapAllocBytes"`
+	HeapObjects    uint64 `json:"heapObjects"`
+	SysBytes       uint64 `json:"sysBytes"`
+	NumGC          uint32 `json:"numGC"`
+	UptimeSeconds  int64  `json:"uptimeSeconds"`
+	DroppedResults int64  `json:"droppedResults"` // Dropped from a full -result-webhook queue
+	// Traffic is the total the checks have caused since startup, and
+	// HostTraffic the same per local host, to help tune intervals on
+	// metered connections.
+	Traffic     trafficCounts            `json:"traffic"`
+	HostTraffic map[string]trafficCounts `json:"hostTraffic"`
+}
+
+// processStart is when the process started, for uptime reporting.
+var processStart = time.Now()
+
+// metricsHandler serves each local host's status and check latency
+// histogram in the OpenMetrics text format, which unlike the classic
+// Prometheus format can carry exemplars: each bucket links to the latest
+// check that fell in it by its trace ID (see -traceparent).
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	type hostMetrics struct {
+		host    string
+		up      bool
+		checks  int
+		latency latencyHistogram
+		traffic trafficCounts
+	}
+	mu.RLock()
+	hosts := make([]hostMetrics, 0, len(hostStatuses))
+	for host, status := range hostStatuses {
+		if hidePending && statusCategory(status.Status) == "pending" {
+			continue
+		}
+		metrics := hostMetrics{host: host, up: status.Status == "UP", checks: status.CheckCount}
+		if stats, ok := hostStatsMap[host]; ok {
+			metrics.latency = stats.latency
+			metrics.traffic = stats.traffic
+		}
+		hosts = append(hosts, metrics)
+	}
+	mu.RUnlock()
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].host < hosts[j].host })
+
+	var b strings.Builder
+	b.WriteString("# TYPE hostmonitor_up gauge\n# HELP hostmonitor_up Whether the host's last check found it UP.\n")
+	for _, h := range hosts {
+		up := 0
+		if h.up {
+			up = 1
+		}
+		fmt.Fprintf(&b, "hostmonitor_up{host=\"%s\"} %d\n", escapeLabel(h.host), up)
+	}
+	b.WriteString("# TYPE hostmonitor_checks counter\n# HELP hostmonitor_checks Checks run against the host.\n")
+	for _, h := range hosts {
+		fmt.Fprintf(&b, "hostmonitor_checks_total{host=\"%s\"} %d\n", escapeLabel(h.host), h.checks)
+	}
+	b.WriteString("# TYPE hostmonitor_requests counter\n# HELP hostmonitor_requests Requests, connections or pings sent by the host's checks.\n")
+	for _, h := range hosts {
+		fmt.Fprintf(&b, "hostmonitor_requests_total{host=\"%s\"} %d\n", escapeLabel(h.host), h.traffic.Requests)
+	}
+	b.WriteString("# TYPE hostmonitor_sent_bytes counter\n# UNIT hostmonitor_sent_bytes bytes\n# HELP hostmonitor_sent_bytes Bytes sent by the host's checks.\n")
+	for _, h := range hosts {
+		fmt.Fprintf(&b, "hostmonitor_sent_bytes_total{host=\"%s\"} %d\n", escapeLabel(h.host), h.traffic.BytesSent)
+	}
+	b.WriteString("# TYPE hostmonitor_received_bytes counter\n# UNIT hostmonitor_received_bytes bytes\n# HELP hostmonitor_received_bytes Bytes received by the host's checks.\n")
+	for _, h := range hosts {
+		fmt.Fprintf(&b, "hostmonitor_received_bytes_total{host=\"%s\"} %d\n", escapeLabel(h.host), h.traffic.BytesReceived)
+	}
+	b.WriteString("# TYPE hostmonitor_check_latency_seconds histogram\n# UNIT hostmonitor_check_latency_seconds seconds\n" +
+		"# HELP hostmonitor_check_latency_seconds Latency of the host's checks.\n")
+	for _, h := range hosts {
+		label := escapeLabel(h.host)
+		var cumulative uint64
+		for i, count := range h.latency.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(&b, "hostmonitor_check_latency_seconds_bucket{host=\"%s\",le=\"%s\"} %d", label, le, cumulative)
+			if e := h.latency.exemplars[i]; e != nil {
+				fmt.Fprintf(&b, " # {trace_id=\"%s\"} %g %.3f", e.traceID, e.value, float64(e.time.UnixMilli())/1000)
+			}
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "hostmonitor_check_latency_seconds_count{host=\"%s\"} %d\n", label, cumulative)
+		fmt.Fprintf(&b, "hostmonitor_check_latency_seconds_sum{host=\"%s\"} %g\n", label, h.latency.sum)
+	}
+	b.WriteString("# EOF\n")
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// escapeLabel escapes a label value for the OpenMetrics text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// debugStatsHandler reports the monitor's own resource usage. When
+// -debug-token is set the request must carry it as a bearer token.
+func debugStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !hasBearerToken(r, debugToken) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := debugStats{
+		Goroutines:     runtime.NumGoroutine(),
+		SSEClients:     sseClients.Load(),
+		HeapAllocBytes: mem.HeapAlloc,
+		HeapObjects:    mem.HeapObjects,
+		SysBytes:       mem.Sys,
+		NumGC:          mem.NumGC,
+		UptimeSeconds:  int64(time.Since(processStart).Seconds()),
+		DroppedResults: droppedResults.Load(),
+	}
+	mu.RLock()
+	stats.Hosts = len(hostStatuses)
+	for _, peer := range peerStatuses {
+		stats.PeerHosts += len(peer)
+	}
+	stats.HostTraffic = make(map[string]trafficCounts, len(hostStatsMap))
+	for host, s := range hostStatsMap {
+		stats.HostTraffic[host] = s.traffic
+		stats.Traffic.Requests += s.traffic.Requests
+		stats.Traffic.BytesSent += s.traffic.BytesSent
+		stats.Traffic.BytesReceived += s.traffic.BytesReceived
+	}
+	mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("Error encoding debug stats JSON: %v", err)
+	}
+}
+
+// hasBearerToken reports whether r carries token as a bearer token. An
+// empty token means no authentication is required.
+func hasBearerToken(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// requireAdmin rejects requests that could change state unless they carry
+// -admin-token, so the dashboard and read-only API can be exposed publicly
+// while control operations stay locked down.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !hasBearerToken(r, adminToken) {
+				log.Printf("Rejected %s %s from %s: missing or wrong admin token", r.Method, r.URL.Path, r.RemoteAddr)
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					apiError(w, "Forbidden: admin token required", http.StatusForbidden)
+				} else {
+					http.Error(w, "Forbidden: admin token required", http.StatusForbidden)
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// transitionsSSEHandler streams one event per status change, for clients
+// that only want changes rather than the full snapshots sent on /events.
+func transitionsSSEHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	sseClients.Add(1)
+	defer sseClients.Add(-1)
+
+	events := transitionFeed.subscribe()
+	defer transitionFeed.unsubscribe(events)
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMs)
+	flusher.Flush()
+
+	// Comment lines keep idle connections from being closed by proxies
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error marshalling JSON: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// sseHandler handles the Server-Sent Events stream, pushing updates to the
+// client. Each event is a statusEnvelope (or an sseDelta with ?delta=1);
+// ?envelope=0 sends the bare statuses that clients from before the envelope
+// expect.
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	// Set headers for Server-Sent Events
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Get a channel to detect when the client closes the connection
+	ctx := r.Context()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	sseClients.Add(1)
+	defer sseClients.Add(-1)
+
+	// Tell browsers how long to wait before reconnecting, so a server
+	// restart doesn't bring every dashboard back at the same instant
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMs)
+	flusher.Flush()
+
+	// In delta mode the client keeps its own copy of the statuses, so a
+	// reconnect always starts from a full snapshot.
+	delta := r.URL.Query().Get("delta") == "1"
+	envelope := wantsEnvelope(r)
+	var sent map[string]HostStatus
+	var lastFullAt time.Time
+
+	// A reconnecting browser sends the id of the last event it received;
+	// if nothing has changed since, the initial dump is skipped.
+	lastSentID := r.Header.Get("Last-Event-ID")
+	if delta {
+		lastSentID = ""
+	}
+	lastSentAt := time.Now()
+
+	// send pushes the current statuses if they changed since the last event
+	// or the resync interval has passed. It returns false once the client
+	// has gone away.
+	send := func(force bool) bool {
+		id := currentEventID()
+		if id == lastSentID && !force {
+			return true
+		}
+		statuses := snapshotStatuses()
+		// Only send data if there are hosts being monitored
+		if len(statuses) == 0 {
+			return true
+		}
+
+		// Marshal and send the full set of statuses, or in delta mode
+		// whatever changed since the last event
+		var payload any = statuses
+		if envelope {
+			now := time.Now()
+			payload = statusEnvelope{ServerTime: now, Hosts: statuses, Summary: summarize(statuses), MaintenanceUntil: globalMaintenanceUntil(now)}
+		}
+		if delta {
+			msg := sseDelta{Hosts: statuses}
+			if sent == nil || time.Since(lastFullAt) >= sseFullResyncInterval {
+				msg.Full = true
+				lastFullAt = time.Now()
+			} else {
+				msg.Hosts = make(map[string]HostStatus)
+				for key, status := range statuses {
+					if prev, ok := sent[key]; !ok || deltaChanged(prev, status) {
+						msg.Hosts[key] = status
+					}
+				}
+				for key := range sent {
+					if _, ok := statuses[key]; !ok {
+						msg.Removed = append(msg.Removed, key)
+					}
+				}
+				// A periodic resync with nothing to send still sends an
+				// empty delta, as a heartbeat for the dashboard's staleness
+				// warning
+				if len(msg.Hosts) == 0 && len(msg.Removed) == 0 && !force {
+					lastSentID, lastSentAt = id, time.Now()
+					return true
+				}
+			}
+			// Remember what the client now holds; a host left out of a
+			// delta keeps the status it was last sent.
+			if msg.Full {
+				sent = statuses
+			} else {
+				for key, status := range msg.Hosts {
+					sent[key] = status
+				}
+				for _, key := range msg.Removed {
+					delete(sent, key)
+				}
+			}
+			msg.ServerTime = time.Now()
+			msg.Summary = summarize(statuses)
+			msg.MaintenanceUntil = globalMaintenanceUntil(msg.ServerTime)
+			payload = msg
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Error marshalling JSON: %v", err)
+			return true
+		}
+
+		// SSE format: id: {version}\ndata: {json_payload}\n\n
+		if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", id, data); err != nil {
+			// Client closed connection (likely)
+			log.Printf("Client disconnected from SSE stream.")
+			return false
+		}
+		flusher.Flush()
+		lastSentID, lastSentAt = id, time.Now()
+		return true
+	}
+
+	// Initial data dump
+	if !send(false) {
+		return
+	}
+
+	// Check for updates every 500ms
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Periodic resyncs carry time-based changes such as staleness
+			if !send(time.Since(lastSentAt) >= sseResyncInterval) {
+				return
+			}
+
+		case <-ctx.Done():
+			// Client connection closed
+			return
+		}
+	}
+}
+
+// Nagios plugin exit codes.
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+// validateConfig checks for -validate, after the flags, the parts of the
+// configuration that main only looks at later: host specs, notifiers and
+// the dashboard template. It prints every error found, starting with errs
+// from checkFlags, and returns the exit code, 1 if there were any. Hosts
+// from -hosts-url and Consul are not fetched, as that would send traffic.
+func validateConfig(errs []error) int {
+	hosts, err := collectHosts()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid host list: %w", err))
+	}
+	if hostsFile != "" {
+		fileHosts, err := (&fileSource{path: hostsFile}).hosts()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid host list: %w", err))
+		}
+		hosts = append(hosts, fileHosts...)
+	}
+	if peersStr == "" && len(hosts) == 0 && len(discoverySources()) == 0 {
+		errs = append(errs, errors.New("no hosts specified: use the -hosts, -hosts-file, -hosts-url or -consul-services flag"))
+	}
+
+	enabled, err := buildNotifiers()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid notifier configuration: %w", err))
+	}
+
+	if t, err := template.New("dashboard").Parse(htmlTemplate); err != nil {
+		errs = append(errs, fmt.Errorf("dashboard template: %w", err))
+	} else if err := t.Execute(io.Discard, dashboardData{}); err != nil {
+		errs = append(errs, fmt.Errorf("dashboard template: %w", err))
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Printf("Configuration OK: %d hosts, %d notifiers\n", len(hosts), len(enabled))
+	if hostsURL != "" || consulServices != "" {
+		fmt.Println("Hosts from -hosts-url and -consul-services were not fetched")
+	}
+	return 0
+}
+
+// runNagiosCheck checks a single host spec for -nagios, prints the result
+// as a Nagios plugin status line with latency and packet loss perfdata, and
+// returns the plugin exit code. A slo_ms option becomes the latency warning
+// threshold.
+func runNagiosCheck(entry string) int {
+	// Plugins are judged by their first line of output
+	log.SetOutput(io.Discard)
+
+	spec, err := parseHostSpec(entry)
+	if err != nil {
+		fmt.Printf("UNKNOWN - %v\n", err)
+		return nagiosUnknown
+	}
+	// A single host is checked as given, without CIDR or range expansion
+	spec.Target = spec.Host
+	result := safeCheck(newCheckClient(spec), spec.Target, spec.Options)
+	result = spec.Options.checkProto(spec.Target, result)
+	if result.Status == "DOWN" && warnReasons[result.Reason] {
+		result.Status = "WARN"
+	}
+	result = spec.Options.expectDown(result, time.Now())
+
+	code, label := nagiosCritical, "CRITICAL"
+	switch {
+	case result.Reason == ReasonInvalid:
+		code, label = nagiosUnknown, "UNKNOWN"
+	case result.Status == expectedDownStatus:
+		code, label = nagiosOK, "OK"
+	case result.Status == "UP" && spec.Options.SLOMs > 0 && result.LatencyMs > spec.Options.SLOMs:
+		code, label = nagiosWarning, "WARNING"
+		result.Err = fmt.Sprintf("latency above %gms objective", spec.Options.SLOMs)
+	case result.Status == "UP":
+		code, label = nagiosOK, "OK"
+	case result.Status == "WARN" || result.Status == "THROTTLED":
+		code, label = nagiosWarning, "WARNING"
+	}
+
+	name := spec.Options.Name
+	if name == "" {
+		name = displayName(spec.Target)
+	}
+	message := fmt.Sprintf("%s %s in %.2fms", name, result.Status, result.LatencyMs)
+	if result.Err != "" {
+		message += ": " + result.Err
+	}
+	warnThreshold := ""
+	if spec.Options.SLOMs > 0 {
+		warnThreshold = strconv.FormatFloat(spec.Options.SLOMs, 'f', -1, 64)
+	}
+	fmt.Printf("%s - %s | latency=%.3fms;%s;;0 packet_loss=%.1f%%;;;0;100\n",
+		label, strings.ReplaceAll(message, "|", "/"), result.LatencyMs, warnThreshold, result.PacketLoss)
+	return code
+}
+
+// collectHosts builds the list of host specs from -hosts, dropping blanks
+// and duplicates. When a discovery source (-hosts-file, -hosts-url or
+// -consul-services) is used, the -hosts default list is only used if -hosts
+// was set explicitly.
+func collectHosts() ([]hostSpec, error) {
+	if len(discoverySources()) > 0 && !flagWasSet("hosts") {
+		return nil, nil
+	}
+	return buildHostSpecs(strings.Split(hostsStr, ","))
+}
+
+// buildHostSpecs parses host entries and expands address ranges, dropping
+// blanks and duplicates.
+func buildHostSpecs(specs []string) ([]hostSpec, error) {
+	seen := make(map[string]bool)
+	hosts := make([]hostSpec, 0, len(specs))
+	for _, entry := range specs {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		spec, err := parseHostSpec(entry)
+		if err != nil {
+			return nil, err
+		}
+		expanded, err := expandHost(spec.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range expanded {
+			key := target
+			if spec.Options.SourceIP.IsValid() {
+				key += " via " + spec.Options.SourceIP.String()
+			}
+			// A host may be listed at several ping sizes, e.g. to find
+			// where large pings fail and small ones still get through
+			if spec.Options.PingSize > 0 {
+				key += fmt.Sprintf(" size %d", spec.Options.PingSize)
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			options := spec.Options
+			if options.Name != "" && len(expanded) > 1 {
+				// Keep the hosts of a named range apart
+				options.Name += " " + target
+			}
+			hosts = append(hosts, hostSpec{Host: key, Target: target, Options: options})
+		}
+	}
+	return hosts, nil
+}
+
+// maxExpandedHosts caps how many hosts a single CIDR block or address range
+// may expand to, so a typo like /8 doesn't start millions of checks.
+const maxExpandedHosts = 1024
+
+// expandHost turns a CIDR block (192.168.1.0/24) or an address range
+// (10.0.0.1-10.0.0.50) into the individual addresses it covers. For IPv4
+// blocks larger than /31 the network and broadcast addresses are skipped.
+// Any other host is returned unchanged.
+func expandHost(host string) ([]string, error) {
+	var first, last netip.Addr
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		prefix = prefix.Masked()
+		first = prefix.Addr()
+		last = lastAddr(prefix)
+		if first.Is4() && prefix.Bits() < 31 {
+			first, last = first.Next(), last.Prev()
+		}
+	} else if from, to, ok := strings.Cut(host, "-"); ok {
+		var errFrom, errTo error
+		first, errFrom = netip.ParseAddr(strings.TrimSpace(from))
+		last, errTo = netip.ParseAddr(strings.TrimSpace(to))
+		if errFrom != nil || errTo != nil {
+			// A host name containing a dash
+			return []string{host}, nil
+		}
+		if first.BitLen() != last.BitLen() || last.Less(first) {
+			return nil, fmt.Errorf("%q: invalid address range", host)
+		}
+	} else {
+		return []string{host}, nil
+	}
+
+	var hosts []string
+	for addr := first; addr.IsValid() && !last.Less(addr); addr = addr.Next() {
+		if len(hosts) == maxExpandedHosts {
+			return nil, fmt.Errorf("%q expands to more than %d hosts", host, maxExpandedHosts)
+		}
+		if addr.Is6() && checkType == "http" {
+			// Bare IPv6 addresses need brackets to become URLs
+			hosts = append(hosts, "["+addr.String()+"]")
+		} else {
+			hosts = append(hosts, addr.String())
+		}
+	}
+	return hosts, nil
+}
+
+// lastAddr returns the highest address in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	raw := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(raw)*8; bit++ {
+		raw[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	return addr
+}
+
+// hostSpec is one configured host: the host itself and any per-host
+// options given after it as ;key=value pairs, e.g.
+// "Billing API=billing.example.com/health;slo_ms=200".
+type hostSpec struct {
+	// Host identifies the host in statuses and the API. It is Target, plus
+	// " via <source>" when a per-host source address is set, so the same
+	// target can be listed once per source.
+	Host    string
+	Target  string // What is checked
+	Options hostOptions
+}
+
+// hostOptions are the per-host settings that can follow a host spec.
+type hostOptions struct {
+	Name       string        // name (or a name= prefix): display name shown instead of the host
+	SLOMs      float64       // slo_ms: latency objective in milliseconds
+	SourceIP   netip.Addr    // source: local address checks are sent from
+	LoginURL   string        // login: URL that login_body is POSTed to for a session cookie
+	LoginBody  string        // login_body: credentials, with $VARS taken from the environment
+	Quiet      *quietHours   // quiet: alerts are held back in these hours (overrides -quiet-hours)
+	Group      string        // group: dashboard group, e.g. the Consul service a host was discovered in
+	ClientCert string        // cert: client certificate for mutual TLS (overrides -client-cert)
+	ClientKey  string        // key: private key for cert
+	Schedule   *cronSchedule // cron: checked on this schedule instead of every interval (lists like 1,15 need a hosts file, as -hosts splits on commas)
+	Critical   bool          // critical: /healthz fails as soon as this host is DOWN
+	Weight     float64       // weight: the host's share in /healthz's weighted DOWN percentage (default 1)
+	SNI        string        // sni: TLS server name and Host header sent instead of the URL's host, for one vhost of many on a shared address
+	Proto      string        // proto: protocol the host is expected to answer over, HTTP/2.0 or HTTP/1.1
+	PingSize   int           // ping_size: payload bytes of its icmp pings (overrides -ping-size)
+	Proxy      *url.URL      // proxy: HTTP CONNECT proxy its checks are tunnelled through (overrides -socks5)
+	SLOTarget  float64       // slo_target: uptime objective in percent whose monthly error budget is tracked (overrides -slo-target)
+	ExpectedUp *quietHours   // expected_up: daily window the host is meant to be up in; failures outside it are EXPECTED_DOWN
+}
+
+// source returns the local address the host's checks are sent from: its
+// own source option, else -source-ip. It is invalid when neither is set.
+func (o hostOptions) source() netip.Addr {
+	if o.SourceIP.IsValid() {
+		return o.SourceIP
+	}
+	return globalSourceIP
+}
+
+// expectDown turns a failed check made at now, outside the host's
+// expected_up window, into EXPECTED_DOWN.
+func (o hostOptions) expectDown(result checkResult, now time.Time) checkResult {
+	if o.ExpectedUp != nil && statusCategory(result.Status) == "down" && !o.ExpectedUp.contains(now) {
+		result.Status = expectedDownStatus
+	}
+	return result
+}
+
+// sloTarget returns the host's uptime objective: its own slo_target
+// option, else -slo-target. It is 0 when neither is set.
+func (o hostOptions) sloTarget() float64 {
+	if o.SLOTarget > 0 {
+		return o.SLOTarget
+	}
+	return sloTarget
+}
+
+// pingSize returns the payload size of the host's icmp pings: its own
+// ping_size option, else -ping-size.
+func (o hostOptions) pingSize() int {
+	if o.PingSize > 0 {
+		return o.PingSize
+	}
+	return pingSize
+}
+
+// clientCertPath returns the file of the host's client certificate, or ""
+// when it presents none.
+func clientCertPath(o hostOptions) string {
+	if cert := o.clientCertificate(); cert != nil {
+		return cert.certFile
+	}
+	return ""
+}
+
+// proxyHost returns the address of a proxy, or "" when there is none.
+func proxyHost(proxy *url.URL) string {
+	if proxy == nil {
+		return ""
+	}
+	return proxy.Host
+}
+
+// sourceString formats a source address, or "" when there is none.
+func sourceString(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
+
+// protoNames maps the values of the proto option to the protocol names
+// HTTP responses report.
+var protoNames = map[string]string{
+	"h2": "HTTP/2.0", "http/2": "HTTP/2.0", "http/2.0": "HTTP/2.0",
+	"http/1.1": "HTTP/1.1",
+}
+
+// checkProto reports an UP check as WARN when the response came over
+// another protocol than the host's proto option expects, e.g. a host
+// moved to HTTP/2 whose ALPN setup has regressed.
+func (o hostOptions) checkProto(host string, result checkResult) checkResult {
+	if o.Proto == "" || result.Status != "UP" || result.Proto == "" || result.Proto == o.Proto {
+		return result
+	}
+	result.Status = "WARN"
+	result.Err = fmt.Sprintf("answered over %s, expected %s", result.Proto, o.Proto)
+	result.Reason = ReasonProto
+	log.Printf("Host %s WARN (%s)", host, result.Err)
+	return result
+}
+
+// globalSourceIP is parsed from -source-ip.
+var globalSourceIP netip.Addr
+
+// hostConfigs holds each local host's spec, protected by mu.
+var hostConfigs = make(map[string]hostSpec)
+
+// parseHostSpec splits a host entry into the host and its options.
+func parseHostSpec(entry string) (hostSpec, error) {
+	parts := strings.Split(entry, ";")
+	spec := hostSpec{Host: strings.TrimSpace(parts[0])}
+	// "name=spec" labels the host. An = after a /, ? or : belongs to the
+	// spec itself, e.g. a query string.
+	if name, host, ok := strings.Cut(spec.Host, "="); ok && !strings.ContainsAny(name, "/?:") {
+		spec.Options.Name = strings.TrimSpace(name)
+		spec.Host = strings.TrimSpace(host)
+	}
+	if spec.Host == "" {
+		return spec, fmt.Errorf("%q: missing host", entry)
+	}
+	for _, option := range parts[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(option), "=")
+		if !ok {
+			return spec, fmt.Errorf("%q: option %q must be key=value", entry, option)
+		}
+		switch key {
+		case "name":
+			spec.Options.Name = strings.TrimSpace(value)
+		case "source":
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return spec, fmt.Errorf("%q: source must be an IP address", entry)
+			}
+			spec.Options.SourceIP = addr
+		case "slo_ms":
+			ms, err := strconv.ParseFloat(value, 64)
+			if err != nil || ms <= 0 {
+				return spec, fmt.Errorf("%q: slo_ms must be a positive number of milliseconds", entry)
+			}
+			spec.Options.SLOMs = ms
+		case "slo_target":
+			target, err := strconv.ParseFloat(value, 64)
+			if err != nil || target <= 0 || target >= 100 {
+				return spec, fmt.Errorf("%q: slo_target must be a percentage above 0 and below 100", entry)
+			}
+			spec.Options.SLOTarget = target
+		case "login":
+			if _, err := url.ParseRequestURI(value); err != nil || checkType != "http" {
+				return spec, fmt.Errorf("%q: login must be an absolute URL and needs -check http", entry)
+			}
+			spec.Options.LoginURL = value
+		case "login_body":
+			spec.Options.LoginBody = value
+		case "group":
+			spec.Options.Group = strings.TrimSpace(value)
+		case "critical":
+			critical, err := strconv.ParseBool(value)
+			if err != nil {
+				return spec, fmt.Errorf("%q: critical must be true or false", entry)
+			}
+			spec.Options.Critical = critical
+		case "weight":
+			weight, err := strconv.ParseFloat(value, 64)
+			if err != nil || weight <= 0 {
+				return spec, fmt.Errorf("%q: weight must be a positive number", entry)
+			}
+			spec.Options.Weight = weight
+		case "cron":
+			schedule, err := parseCron(value)
+			if err != nil {
+				return spec, fmt.Errorf("%q: cron: %v", entry, err)
+			}
+			spec.Options.Schedule = schedule
+		case "cert":
+			spec.Options.ClientCert = value
+		case "key":
+			spec.Options.ClientKey = value
+		case "sni":
+			if value == "" || strings.ContainsAny(value, "/:") || checkType != "http" {
+				return spec, fmt.Errorf("%q: sni must be a host name and needs -check http", entry)
+			}
+			spec.Options.SNI = value
+		case "proxy":
+			proxy, err := parseConnectProxy(value)
+			if err != nil || checkType != "http" {
+				return spec, fmt.Errorf("%q: proxy must be [user:password@]host:port and needs -check http", entry)
+			}
+			spec.Options.Proxy = proxy
+		case "proto":
+			proto, ok := protoNames[strings.ToLower(value)]
+			if !ok || checkType != "http" {
+				return spec, fmt.Errorf("%q: proto must be h2 or http/1.1 and needs -check http", entry)
+			}
+			spec.Options.Proto = proto
+		case "ping_size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < minPingSize || size > maxPingSize || checkType != "icmp" {
+				return spec, fmt.Errorf("%q: ping_size must be between %d and %d bytes and needs -check icmp", entry, minPingSize, maxPingSize)
+			}
+			if !canSetDontFragment {
+				return spec, fmt.Errorf("%q: ping_size needs Linux, where pings can be sent with Don't Fragment", entry)
+			}
+			spec.Options.PingSize = size
+		case "expected_up":
+			window, err := parseQuietHours(value)
+			if err != nil || window.start == window.end {
+				return spec, fmt.Errorf("%q: expected_up must look like 08:00-18:00[@Zone]", entry)
+			}
+			spec.Options.ExpectedUp = window
+		case "quiet":
+			quiet, err := parseQuietHours(value)
+			if err != nil {
+				return spec, fmt.Errorf("%q: quiet: %v", entry, err)
+			}
+			spec.Options.Quiet = quiet
+		default:
+			return spec, fmt.Errorf("%q: unknown option %q", entry, key)
+		}
+	}
+	if spec.Options.LoginBody != "" && spec.Options.LoginURL == "" {
+		return spec, fmt.Errorf("%q: login_body needs a login URL", entry)
+	}
+	if (spec.Options.ClientCert == "") != (spec.Options.ClientKey == "") {
+		return spec, fmt.Errorf("%q: cert and key must be given together", entry)
+	}
+	return spec, nil
+}
+
+// fetchHostEntries downloads the host list at -hosts-url: a JSON array of
+// host specs, or one spec per line like a hosts file.
+func fetchHostEntries(listURL string) ([]string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("[")) {
+		var entries []string
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON host list: %v", err)
+		}
+		return entries, nil
+	}
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+// discoverySource supplies hosts to monitor that may change while the
+// monitor runs. Every source is polled by the same inventory loop.
+type discoverySource interface {
+	// name identifies the source in logs, e.g. the flag that configures it.
+	name() string
+	// hosts returns the source's current hosts.
+	hosts() ([]hostSpec, error)
+}
+
+// fileSource lists the hosts in -hosts-file, reread on every refresh.
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) name() string { return "-hosts-file" }
+
+func (s *fileSource) hosts() ([]hostSpec, error) {
+	entries, err := readHostsFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return buildHostSpecs(entries)
+}
+
+// urlSource lists the hosts served at -hosts-url.
+type urlSource struct {
+	url string
+}
+
+func (s *urlSource) name() string { return "-hosts-url" }
+
+func (s *urlSource) hosts() ([]hostSpec, error) {
+	entries, err := fetchHostEntries(s.url)
+	if err != nil {
+		return nil, err
+	}
+	return buildHostSpecs(entries)
+}
+
+// consulSource lists the instances of some services that pass their Consul
+// health checks. Each instance is grouped under its service's name.
+type consulSource struct {
+	url      string // Consul HTTP API, e.g. http://127.0.0.1:8500
+	services []string
+	tag      string // Only instances with this tag, if set
+	token    string
+	scheme   string // For http checks: instances are checked at scheme://address:port/path
+	path     string
+}
+
+func (s *consulSource) name() string { return "-consul-services" }
+
+// consulInstance is the part of a /v1/health/service entry we use.
+type consulInstance struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+func (s *consulSource) hosts() ([]hostSpec, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var hosts []hostSpec
+	for _, service := range s.services {
+		query := url.Values{"passing": {"true"}}
+		if s.tag != "" {
+			query.Set("tag", s.tag)
+		}
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(s.url, "/")+"/v1/health/service/"+url.PathEscape(service)+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if s.token != "" {
+			req.Header.Set("X-Consul-Token", s.token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var instances []consulInstance
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("service %s: unexpected status %d", service, resp.StatusCode)
+		} else {
+			err = json.NewDecoder(io.LimitReader(resp.Body, maxBodyBytes)).Decode(&instances)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, instance := range instances {
+			// An instance without an address of its own uses its node's
+			address := instance.Service.Address
+			if address == "" {
+				address = instance.Node.Address
+			}
+			target := net.JoinHostPort(address, strconv.Itoa(instance.Service.Port))
+			switch checkType {
+			case "http":
+				target = s.scheme + "://" + target + s.path
+			case "icmp":
+				target = address
+			}
+			hosts = append(hosts, hostSpec{Host: target, Target: target, Options: hostOptions{Group: service}})
+		}
+	}
+	return hosts, nil
+}
+
+// discoverySources returns the sources configured by flags.
+func discoverySources() []discoverySource {
+	var sources []discoverySource
+	if hostsFile != "" {
+		sources = append(sources, &fileSource{path: hostsFile})
+	}
+	if hostsURL != "" {
+		sources = append(sources, &urlSource{url: hostsURL})
+	}
+	if consulServices != "" {
+		source := &consulSource{url: consulURL, tag: consulTag, token: os.Getenv("CONSUL_HTTP_TOKEN"), scheme: consulScheme, path: consulPath}
+		for _, service := range strings.Split(consulServices, ",") {
+			if service = strings.TrimSpace(service); service != "" {
+				source.services = append(source.services, service)
+			}
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// inventory keeps the monitors in step with the discovery sources. Hosts
+// given by -hosts are left alone.
+type inventory struct {
+	sources  []discoverySource
+	interval time.Duration
+	static   map[string]bool       // Keys of the -hosts hosts
+	known    map[string][]hostSpec // Each source's last successful answer
+	current  map[string]hostSpec   // Hosts currently monitored from the sources
+}
+
+// fetch polls every source and returns the hosts they list together. A
+// source that fails contributes its last known hosts instead.
+func (inv *inventory) fetch() map[string]hostSpec {
+	wanted := make(map[string]hostSpec)
+	for _, source := range inv.sources {
+		specs, err := source.hosts()
+		if err != nil {
+			specs = inv.known[source.name()]
+			log.Printf("Could not read hosts from %s, keeping the last known %d: %v", source.name(), len(specs), err)
+		} else {
+			inv.known[source.name()] = specs
+		}
+		for _, spec := range specs {
+			// The first source to list a host wins
+			if _, ok := wanted[spec.Host]; !ok && !inv.static[spec.Host] {
+				wanted[spec.Host] = spec
+			}
+		}
+	}
+	return wanted
+}
+
+// sync polls the sources and starts and stops monitors to match them.
+func (inv *inventory) sync(ctx context.Context) {
+	inv.apply(ctx, inv.fetch())
+}
+
+// apply starts and stops monitors so the discovered hosts are those wanted.
+func (inv *inventory) apply(ctx context.Context, wanted map[string]hostSpec) {
+	added, removed := 0, 0
+	for host, spec := range inv.current {
+		// A host whose options changed is restarted with the new ones
+		if next, ok := wanted[host]; !ok || !reflect.DeepEqual(next, spec) {
+			stopMonitor(host)
+			delete(inv.current, host)
+			removed++
+		}
+	}
+	for host, spec := range wanted {
+		if _, ok := inv.current[host]; !ok {
+			startMonitor(ctx, spec, inv.interval)
+			inv.current[host] = spec
+			added++
+		}
+	}
+	if added > 0 || removed > 0 {
+		log.Printf("Discovered hosts changed: %d started, %d stopped, %d discovered in total", added, removed, len(inv.current))
+	}
+}
+
+// run refreshes the hosts every refresh interval until ctx is cancelled.
+func (inv *inventory) run(ctx context.Context, refresh time.Duration) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			inv.sync(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readHostsFile reads one host spec per line. Blank lines and lines starting
+// with # are ignored; commas are not treated as separators.
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var specs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		specs = append(specs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return specs, nil
+}
+
+// envPrefix starts the environment variables that configure flags: -hosts
+// is read from HOSTMONITOR_HOSTS, -slo-window from HOSTMONITOR_SLO_WINDOW.
+const envPrefix = "HOSTMONITOR_"
+
+// envName returns the environment variable for a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvFlags sets every flag not given on the command line from its
+// environment variable, if present. Flags take precedence, and a flag set
+// this way counts as set, e.g. for -hosts alongside -hosts-file.
+func applyEnvFlags() error {
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || setOnCommandLine[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s=%q: %v", envName(f.Name), value, setErr)
+		}
+	})
+	return err
+}
+
+// flagWasSet reports whether the named flag was given on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// listenUnix listens on a Unix socket at path that only its owner and group
+// can connect to. A socket left behind by a monitor that didn't shut down
+// cleanly is replaced, but not one still in use. Closing the listener, as
+// server.Shutdown does, removes the socket file.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use, perhaps by another host-monitor", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the socket without permissions for others, so no one else
+	// can connect before the chmod
+	oldMask := setUmask(0o117)
+	listener, err := net.Listen("unix", path)
+	setUmask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// servePprof serves the net/http/pprof handlers on their own listener, so
+// profiling is never exposed on the public dashboard port.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	log.Printf("Profiling available at http://%s/debug/pprof/", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("pprof server stopped: %v", err)
+	}
+}
+
+// dashboardData is what the dashboard template is rendered with.
+type dashboardData struct {
+	LatencyWarnMs  float64
+	LatencyCritMs  float64
+	HidePending    bool
+	PollIntervalMs int64
+	PushIntervalMs int64
+}
+
+// embeddedAssets holds the dashboard's static files, compiled into the
+// binary so the dashboard needs nothing from outside the monitor and works
+// on networks without internet access.
+//
+//go:embed assets
+var embeddedAssets embed.FS
+
+// assetsHandler serves the embedded static files under /assets/. They only
+// change with the binary, so browsers may cache them for a while.
+func assetsHandler() http.Handler {
+	assets, err := fs.Sub(embeddedAssets, "assets")
+	if err != nil {
+		// Only possible if the embed directive and the path disagree
+		panic(err)
+	}
+	files := http.StripPrefix("/assets/", http.FileServer(http.FS(assets)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// indexHandler serves the main HTML dashboard template.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	// "/" is a catch-all pattern; only the root path is the dashboard
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	t, err := template.New("dashboard").Parse(htmlTemplate)
+	if err != nil {
+		http.Error(w, "Could not parse template", http.StatusInternalServerError)
+		return
+	}
+	t.Execute(w, dashboardData{
+		LatencyWarnMs:  latencyWarnMs,
+		LatencyCritMs:  latencyCritMs,
+		HidePending:    hidePending,
+		PollIntervalMs: dashboardPoll.Milliseconds(),
+		PushIntervalMs: sseResyncInterval.Milliseconds(),
+	})
+}
+
+// checkFlags checks the flags and sets up what is derived from them, such
+// as compiled patterns and parsed addresses. It returns every error found,
+// so -validate can report them all.
+func checkFlags() []error {
+	var errs []error
+	if strings.HasPrefix(expectRedirect, "~") {
+		re, err := regexp.Compile(expectRedirect[1:])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -expect-redirect pattern: %v", err))
+		} else {
+			expectRedirectRe = re
+		}
+	}
+
+	if checkType != "http" && checkType != "exec" && checkType != "tcp" && checkType != "udp" && checkType != "icmp" {
+		errs = append(errs, fmt.Errorf("invalid -check %q: must be http, exec, tcp, udp or icmp", checkType))
+	}
+	if pingCount < 1 {
+		errs = append(errs, fmt.Errorf("invalid -ping-count %d: must be at least 1", pingCount))
+	}
+	if pingSize < minPingSize || pingSize > maxPingSize {
+		errs = append(errs, fmt.Errorf("invalid -ping-size %d: must be between %d and %d", pingSize, minPingSize, maxPingSize))
+	}
+	if flagWasSet("ping-size") && !canSetDontFragment {
+		// Pings larger than the path MTU would be fragmented and succeed
+		errs = append(errs, errors.New("-ping-size needs Linux, where pings can be sent with Don't Fragment"))
+	}
+	if warnLoss < 0 || warnLoss > 100 || downLoss <= 0 || downLoss > 100 {
+		errs = append(errs, errors.New("invalid -warn-loss or -down-loss: must be percentages, and -down-loss above 0"))
+	}
+	if warnLoss > downLoss {
+		errs = append(errs, fmt.Errorf("invalid -warn-loss %v: must not exceed -down-loss %v", warnLoss, downLoss))
+	}
+	if checkType == "udp" {
+		var err error
+		if udpPayloadBytes, err = parseProbeData(udpPayload); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -udp-payload: %v", err))
+		}
+		if udpExpectBytes, err = parseProbeData(udpExpect); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -udp-expect: %v", err))
+		}
+	}
+	if checkType == "tcp" {
+		var err error
+		if tcpSendBytes, err = parseProbeData(tcpSend); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -tcp-send: %v", err))
+		}
+		if tcpExpectBytes, err = parseProbeData(tcpExpect); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -tcp-expect: %v", err))
+		}
+		if tcpHold < 0 || tcpHold >= checkTimeout() {
+			errs = append(errs, fmt.Errorf("invalid -tcp-hold %v: must be shorter than -timeout", tcpHold))
+		}
+	}
+	if timeoutMs <= 0 {
+		errs = append(errs, fmt.Errorf("invalid -timeout %d: must be positive", timeoutMs))
+	}
+	if quietHoursSpec != "" {
+		quiet, err := parseQuietHours(quietHoursSpec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -quiet-hours: %v", err))
+		} else {
+			globalQuietHours = quiet
+		}
+	}
+	if emitLog != "" && emitLog != "checks" && emitLog != "transitions" {
+		errs = append(errs, fmt.Errorf("invalid -emit-log %q: must be checks or transitions", emitLog))
+	}
+	if bindAddr != "" {
+		if _, err := netip.ParseAddr(bindAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -bind %q: must be an IP address such as 127.0.0.1 or ::1", bindAddr))
+		}
+	}
+	if stepTimeoutMs < 0 {
+		errs = append(errs, fmt.Errorf("invalid -step-timeout %d: must not be negative", stepTimeoutMs))
 	}
-	mu.Unlock()
 
-	log.Printf("Starting monitoring for host: %s at %v intervals", host, interval)
+	if sourceIP != "" {
+		addr, err := netip.ParseAddr(sourceIP)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -source-ip: %v", err))
+		} else {
+			globalSourceIP = addr
+		}
+	}
 
-	// Define a custom HTTP client with a timeout for the check
-	client := http.Client{
-		// Set a connection timeout to prevent checks from hanging indefinitely
-		Timeout: 5 * time.Second,
+	if resolverAddr != "" {
+		resolver, err := newResolver(resolverAddr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -resolver: %v", err))
+		} else {
+			checkResolver = resolver
+		}
 	}
 
-	for range ticker.C {
-		var status string
-		var latency float64 = 0.0
-		var packetLoss float64 = 0.0 // Always 0% for a single HTTP check
+	if dashboardPoll < time.Second {
+		errs = append(errs, fmt.Errorf("invalid -dashboard-poll-interval %v: must be at least 1s", dashboardPoll))
+	}
 
-		// Prepend scheme if missing for http.Client to work
-		url := host
-		if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
-			url = "http://" + host // Default to HTTP for simplicity
+	if maxRedirects != 0 {
+		// Go's client gives up after 10 redirects, failing the check
+		if maxRedirects < 0 || maxRedirects >= 10 {
+			errs = append(errs, fmt.Errorf("invalid -max-redirects %d: must be between 1 and 9", maxRedirects))
 		}
+		if checkType != "http" {
+			errs = append(errs, errors.New("-max-redirects only applies to http checks"))
+		}
+		if !followRedirects || expectRedirect != "" {
+			errs = append(errs, errors.New("-max-redirects needs redirects to be followed, so can't be used with -follow-redirects=false or -expect-redirect"))
+		}
+	}
 
-		startTime := time.Now()
+	if dualStack {
+		if checkType != "http" {
+			errs = append(errs, errors.New("-dual-stack only applies to http checks"))
+		}
+		if socks5Addr != "" {
+			errs = append(errs, errors.New("-dual-stack can't be used with -socks5, which connects to hosts itself"))
+		}
+	}
 
-		// Use a HEAD request, which is lighter than GET as it only requests headers
-		req, err := http.NewRequest("HEAD", url, nil)
+	if socks5Addr != "" {
+		if checkType != "http" {
+			errs = append(errs, errors.New("-socks5 only applies to http checks"))
+		}
+		proxyURL, err := parseSOCKS5(socks5Addr)
 		if err != nil {
-			log.Printf("Error creating request for %s: %v", host, err)
-			status = "DOWN"
+			errs = append(errs, fmt.Errorf("invalid -socks5: %v", err))
 		} else {
-			resp, err := client.Do(req)
-
-			if err != nil {
-				// Connection refused, timeout, or DNS error
-				status = "DOWN"
-				log.Printf("Host %s DOWN (Error: %v)", host, err)
-			} else {
-				defer resp.Body.Close()
-
-				// Calculate actual latency
-				latency = float64(time.Since(startTime).Microseconds()) / 1000.0 // Convert to milliseconds
-
-				// A 2xx status code is generally considered UP
-				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-					status = "UP"
-				} else {
-					status = "DOWN" // Treat non-2xx as a service failure
-					log.Printf("Host %s DOWN (Status: %d)", host, resp.StatusCode)
-				}
-			}
+			socks5Proxy = proxyURL
 		}
+	}
 
-		mu.Lock()
-		currentStatus := hostStatuses[host]
-		currentStatus.Status = status
-		// Use float64 for type conversion
-		currentStatus.LatencyMs = float64(int(latency*100)) / 100.0   // Round to 2 decimals
-		currentStatus.PacketLoss = float64(int(packetLoss*10)) / 10.0 // Round to 1 decimal
-		currentStatus.LastCheck = time.Now()
-		currentStatus.CheckCount++
-		hostStatuses[host] = currentStatus
-		mu.Unlock()
+	if (clientCertFile == "") != (clientKeyFile == "") {
+		errs = append(errs, errors.New("-client-cert and -client-key must be given together"))
+	}
+	if clientCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -client-cert: %v", err))
+		}
+	}
+	if _, ok := tlsVersions[minTLS]; minTLS != "" && !ok {
+		errs = append(errs, fmt.Errorf("invalid -min-tls %q: must be 1.0, 1.1, 1.2 or 1.3", minTLS))
 	}
-}
 
-// sseHandler handles the Server-Sent Events stream, pushing updates to the client.
-func sseHandler(w http.ResponseWriter, r *http.Request) {
-	// Set headers for Server-Sent Events
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	checkMethod = strings.ToUpper(checkMethod)
+	if checkMethod != "HEAD" && checkMethod != "GET" && checkMethod != "POST" {
+		errs = append(errs, fmt.Errorf("invalid -method %q: must be HEAD, GET or POST", checkMethod))
+	}
 
-	// Get a channel to detect when the client closes the connection
-	ctx := r.Context()
+	switch {
+	case requestBody != "" && requestBodyFile != "":
+		errs = append(errs, errors.New("-body and -body-file cannot be used together"))
+	case (requestBody != "" || requestBodyFile != "") && checkMethod != "POST":
+		errs = append(errs, errors.New("-body and -body-file require -method POST"))
+	case requestBodyFile != "":
+		data, err := os.ReadFile(requestBodyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -body-file: %v", err))
+		} else {
+			checkBody = data
+		}
+	case checkMethod == "POST":
+		// An empty body is still sent, with its Content-Type
+		checkBody = []byte(requestBody)
+	}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
-		return
+	if expectJSON != "" {
+		path, value, err := parseExpectJSON(expectJSON)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -expect-json: %v", err))
+		} else {
+			expectJSONPath, expectJSONValue = path, value
+		}
+		if checkMethod == "HEAD" {
+			// A HEAD response has no body to inspect
+			log.Println("-expect-json requires a response body; using GET for checks")
+			checkMethod = "GET"
+		}
 	}
 
-	// Initial data dump
-	mu.RLock()
-	statuses := hostStatuses
-	mu.RUnlock()
+	if reasons, err := parseWarnOn(warnOn); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -warn-on: %v", err))
+	} else {
+		warnReasons = reasons
+	}
 
-	// Handle case where statuses map might be empty on rapid disconnect/reconnect
-	if len(statuses) > 0 {
-		data, _ := json.Marshal(statuses)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+	if rateLimit < 0 {
+		errs = append(errs, fmt.Errorf("invalid -rate-limit %v: must not be negative", rateLimit))
+	} else if rateLimit > 0 {
+		checkLimiter = newRateLimiter(rateLimit)
 	}
 
-	// Loop to send updates every 500ms
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+	if jitterPercent < 0 || jitterPercent >= 100 {
+		errs = append(errs, fmt.Errorf("invalid -jitter-percent %v: must be at least 0 and below 100", jitterPercent))
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			mu.RLock()
-			// Only send data if there are hosts being monitored
-			if len(hostStatuses) > 0 {
-				statuses := hostStatuses
-				mu.RUnlock()
-
-				// Marshal and send the full set of statuses
-				data, err := json.Marshal(statuses)
-				if err != nil {
-					log.Printf("Error marshalling JSON: %v", err)
-					continue
-				}
+	if sloWindow <= 0 {
+		errs = append(errs, fmt.Errorf("invalid -slo-window %v: must be positive", sloWindow))
+	}
+	if latencyWarnMs < 0 || latencyCritMs < 0 {
+		errs = append(errs, errors.New("invalid -latency-warn-ms or -latency-crit-ms: must not be negative"))
+	}
+	if latencyWarnMs > 0 && latencyCritMs > 0 && latencyWarnMs > latencyCritMs {
+		errs = append(errs, fmt.Errorf("invalid -latency-warn-ms %v: must not exceed -latency-crit-ms %v", latencyWarnMs, latencyCritMs))
+	}
+	if healthThreshold <= 0 || healthThreshold > 100 {
+		errs = append(errs, fmt.Errorf("invalid -health-threshold %v: must be above 0 and at most 100", healthThreshold))
+	}
+	if sloAlertPercent < 0 || sloAlertPercent > 100 {
+		errs = append(errs, fmt.Errorf("invalid -slo-alert-percent %v: must be between 0 and 100", sloAlertPercent))
+	}
+	if sloTarget < 0 || sloTarget >= 100 {
+		errs = append(errs, fmt.Errorf("invalid -slo-target %v: must be a percentage below 100, or 0 for none", sloTarget))
+	}
 
-				// SSE format: data: {json_payload}\n\n
-				_, err = fmt.Fprintf(w, "data: %s\n\n", data)
-				if err != nil {
-					// Client closed connection (likely)
-					log.Printf("Client disconnected from SSE stream.")
-					return
-				}
-				flusher.Flush()
-			} else {
-				mu.RUnlock()
-			}
+	if workers < 0 {
+		errs = append(errs, fmt.Errorf("invalid -workers %d: must not be negative", workers))
+	}
+	if incidentWindow < 0 {
+		errs = append(errs, fmt.Errorf("invalid -incident-window %v: must not be negative", incidentWindow))
+	}
+	if incidentMinHosts < 2 {
+		errs = append(errs, fmt.Errorf("invalid -incident-min-hosts %d: must be at least 2", incidentMinHosts))
+	}
 
-		case <-ctx.Done():
-			// Client connection closed
-			return
+	if resultWebhook != "" {
+		if u, err := url.Parse(resultWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid -result-webhook %q: must be an http(s) URL", resultWebhook))
+		}
+		if resultBatchWindow <= 0 {
+			errs = append(errs, fmt.Errorf("invalid -result-batch-window %v: must be positive", resultBatchWindow))
+		}
+		if resultBatchSize < 1 {
+			errs = append(errs, fmt.Errorf("invalid -result-batch-size %d: must be at least 1", resultBatchSize))
 		}
 	}
-}
 
-// indexHandler serves the main HTML dashboard template.
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	t, err := template.New("dashboard").Parse(htmlTemplate)
-	if err != nil {
-		http.Error(w, "Could not parse template", http.StatusInternalServerError)
-		return
+	if peers, err := parsePeers(peersStr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -peers: %w", err))
+	} else {
+		configuredPeers = peers
+	}
+	if follower {
+		if u, err := url.Parse(leaderURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("-follower needs -leader-url, the http(s) base URL of the leader"))
+		}
+		if failoverAfter <= 0 {
+			errs = append(errs, fmt.Errorf("invalid -failover-after %v: must be positive", failoverAfter))
+		}
 	}
-	t.Execute(w, nil)
+	if hostsRefresh < 0 {
+		errs = append(errs, fmt.Errorf("invalid -hosts-refresh %v: must not be negative", hostsRefresh))
+	}
+	if consulServices != "" && checkType == "exec" {
+		errs = append(errs, errors.New("-consul-services needs -check http, tcp, udp or icmp"))
+	}
+	if hostsURL != "" && checkType == "exec" {
+		// Every entry would be run as a command by whoever controls the URL
+		errs = append(errs, errors.New("-hosts-url needs -check http, tcp, udp or icmp"))
+	}
+	return errs
 }
 
 func main() {
 	// Parse the flags here, after defining them in init()
 	flag.Parse()
+	envErr := applyEnvFlags()
 
 	rand.Seed(time.Now().UnixNano()) // Seed random for simulation
 
+	errs := checkFlags()
+	if envErr != nil {
+		errs = append([]error{fmt.Errorf("invalid environment: %w", envErr)}, errs...)
+	}
+	if validateOnly {
+		os.Exit(validateConfig(errs))
+	}
+	for _, err := range errs {
+		log.Print(err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	if resultWebhook != "" {
+		// Made before any check runs, as recordResult reads it unlocked
+		resultQueue = make(chan HostStatus, resultQueueSize)
+	}
+
+	if nagiosHost != "" {
+		os.Exit(runNagiosCheck(nagiosHost))
+	}
+
 	log.Println("Starting Service Monitoring Service...")
 
 	// 1. Start Service Monitoring Goroutines
-	hosts := strings.Split(hostsStr, ",")
 	interval := time.Duration(intervalMs) * time.Millisecond
 
-	if len(hosts) == 0 || (len(hosts) == 1 && hosts[0] == "") {
-		log.Fatal("No hosts specified. Please use the -hosts flag.")
+	peers := configuredPeers
+	filteredHosts, err := collectHosts()
+	if err != nil {
+		log.Fatalf("Invalid host list: %v", err)
+	}
+
+	// Discovered hosts, first read now so their saved stats are restored
+	// with the others. A broken -hosts-file is still a startup error.
+	inv := &inventory{
+		sources:  discoverySources(),
+		interval: interval,
+		static:   make(map[string]bool),
+		known:    make(map[string][]hostSpec),
+		current:  make(map[string]hostSpec),
+	}
+	for _, spec := range filteredHosts {
+		inv.static[spec.Host] = true
+	}
+	if hostsFile != "" {
+		if _, err := (&fileSource{path: hostsFile}).hosts(); err != nil {
+			log.Fatalf("Invalid host list: %v", err)
+		}
+	}
+	discovered := inv.fetch()
+
+	// A collector may aggregate peers without monitoring anything itself,
+	// and discovery sources may not list anything yet
+	if len(peers) == 0 && len(filteredHosts) == 0 && len(inv.sources) == 0 {
+		log.Fatal("No hosts specified. Please use the -hosts, -hosts-file, -hosts-url or -consul-services flag.")
 	}
 
-	filteredHosts := make([]string, 0)
-	for _, host := range hosts {
-		host = strings.TrimSpace(host)
-		if host != "" {
-			filteredHosts = append(filteredHosts, host)
-			go monitorHost(host, interval)
+	// Restore saved stats before the monitors start recording new checks
+	if stateFilePath != "" {
+		allHosts := slices.Clone(filteredHosts)
+		for _, spec := range discovered {
+			allHosts = append(allHosts, spec)
+		}
+		if err := loadState(stateFilePath, allHosts); err != nil {
+			log.Printf("Could not restore state: %v", err)
 		}
 	}
 
-	// 2. Setup HTTP routes
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/events", sseHandler)
+	// Cancelled on shutdown so no checks are recorded after state is saved
+	monitorCtx, stopMonitors := context.WithCancel(context.Background())
+	defer stopMonitors()
 
-	// 3. Start Web Server
-	addr := ":" + strconv.Itoa(port)
-	log.Printf("Web Dashboard available at http://localhost%s", addr)
-	// Log the confirmed settings
-	log.Printf("Monitoring %d hosts (Interval: %dms, Port: %d)", len(filteredHosts), intervalMs, port)
+	if workers > 0 {
+		checkScheduler = newScheduler(monitorCtx, workers)
+		log.Printf("Running checks on a pool of %d workers", workers)
+	}
+	startChecks := func(discovered map[string]hostSpec) {
+		for _, spec := range filteredHosts {
+			startMonitor(monitorCtx, spec, interval)
+		}
+		if len(inv.sources) > 0 {
+			inv.apply(monitorCtx, discovered)
+			if hostsRefresh > 0 {
+				go inv.run(monitorCtx, hostsRefresh)
+			}
+		}
+	}
+	if follower {
+		// Rediscover on taking over, as the startup list may be long out of date
+		go followLeader(monitorCtx, leaderURL, interval, func() { startChecks(inv.fetch()) })
+	} else {
+		startChecks(discovered)
+	}
 
-	err := http.ListenAndServe(addr, nil)
+	notifiers, err = buildNotifiers()
 	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		log.Fatalf("Invalid notifier configuration: %v", err)
+	}
+	for _, n := range notifiers {
+		log.Printf("Alerting enabled via %s", n.Name())
+	}
+	go newAlertManager().run(transitionEvents, maintenanceSummaries)
+	if resultQueue != nil {
+		go sendResults(resultQueue)
+		log.Printf("Sending every check result to %s", resultWebhook)
+	}
+	go compactHistories(monitorCtx)
+
+	for _, p := range peers {
+		go pollPeer(p, interval)
+	}
+
+	// 2. Setup HTTP routes. The dashboard uses its own mux rather than
+	// http.DefaultServeMux, which net/http/pprof registers itself on.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", indexHandler)
+	mux.Handle("/assets/", assetsHandler())
+	mux.HandleFunc("/events", sseHandler)
+	mux.HandleFunc("/events/transitions", transitionsSSEHandler)
+	mux.HandleFunc("/api/status", apiStatusHandler)
+	mux.HandleFunc("/api/hosts/", hostsAPIHandler)
+	mux.HandleFunc("/api/config", apiConfigHandler)
+	mux.HandleFunc("/api/summary", apiSummaryHandler)
+	mux.HandleFunc("/api/diff", apiDiffHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/api/maintenance", apiMaintenanceHandler)
+	mux.HandleFunc("/api/incidents", apiIncidentsHandler)
+	mux.HandleFunc("/api/", apiNotFoundHandler)
+	mux.HandleFunc("/debug/stats", debugStatsHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	if pprofAddr != "" {
+		go servePprof(pprofAddr)
+	}
+
+	// 3. Start Web Server, on TCP and/or a Unix socket
+	var listeners []net.Listener
+	if unixSocket != "" {
+		listener, err := listenUnix(unixSocket)
+		if err != nil {
+			log.Fatalf("Failed to listen on -unix-socket: %v", err)
+		}
+		log.Printf("Listening on unix:%s", unixSocket)
+		listeners = append(listeners, listener)
+	}
+	if unixSocket == "" || flagWasSet("port") || flagWasSet("bind") {
+		listener, err := net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(port)))
+		switch {
+		case errors.Is(err, syscall.EADDRINUSE):
+			log.Fatalf("Port %d is already in use, perhaps by another host-monitor that is still shutting down. "+
+				"Choose a different one with -port, or use -port 0 to pick any free port.", port)
+		case errors.Is(err, syscall.EACCES):
+			log.Fatalf("Not allowed to listen on port %d; ports below 1024 usually need root. Choose a different one with -port.", port)
+		case err != nil:
+			log.Fatalf("Failed to start server: %v", err)
+		}
+		// With -port 0 the system picked the port, so report the real one
+		port = listener.Addr().(*net.TCPAddr).Port
+		dashboardHost := bindAddr
+		if dashboardHost == "" || net.ParseIP(dashboardHost).IsUnspecified() {
+			dashboardHost = "localhost"
+		}
+		log.Printf("Listening on %s", listener.Addr())
+		log.Printf("Web Dashboard available at http://%s", net.JoinHostPort(dashboardHost, strconv.Itoa(port)))
+		listeners = append(listeners, listener)
+	} else {
+		port = 0 // Not listening on TCP
+	}
+	// Log the confirmed settings
+	log.Printf("Monitoring %d hosts and %d peers (Interval: %dms, Port: %d)", len(filteredHosts)+len(discovered), len(peers), intervalMs, port)
+
+	// Long-lived SSE handlers watch the request context, so cancel it on
+	// shutdown rather than waiting for browsers to disconnect
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	server := &http.Server{
+		Handler:     requireAdmin(mux),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	server.RegisterOnShutdown(cancelBase)
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+		}(listener)
+	}
+
+	// 4. Wait for a shutdown signal, then stop serving and save state
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error during server shutdown: %v", err)
+	}
+	stopMonitors()
+
+	if stateFilePath != "" {
+		if err := saveState(stateFilePath); err != nil {
+			log.Printf("Could not save state: %v", err)
+		} else {
+			log.Printf("Saved host stats to %s", stateFilePath)
+		}
 	}
 }
 
-// The HTML/CSS/JavaScript template for the dashboard
+// The HTML/CSS/JavaScript template for the dashboard. It loads nothing from
+// outside the monitor: Tailwind classes come from the vendored subset in
+// assets/tailwind.css, so any class used here must be present there.
 const htmlTemplate = `
 <!DOCTYPE html>
 <html lang="en">
@@ -249,14 +7971,32 @@ const htmlTemplate = `
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
     <title>Host Monitor Dashboard in GoLang for Linux</title>
-    <script src="https://cdn.tailwindcss.com"></script>
-    <link href="https://fonts.googleapis.com/css2?family=Inter:wght@400;600;700&display=swap" rel="stylesheet">
+    <link href="/assets/tailwind.css" rel="stylesheet">
     <style>
-        body { font-family: 'Inter', sans-serif; background-color: #f7fafc; }
+        /* Inter where it is installed, without fetching it from a font CDN */
+        body { font-family: 'Inter', system-ui, -apple-system, 'Segoe UI', Roboto, sans-serif; background-color: #f7fafc; }
         .card { transition: all 0.3s ease; }
         .status-up { background-color: #d1fae5; color: #065f46; border-left: 4px solid #10b981; }
         .status-down { background-color: #fee2e2; color: #991b1b; border-left: 4px solid #ef4444; animation: pulse-down 1.5s infinite; }
-        .status-init { background-color: #eff6ff; color: #1e40af; border-left: 4px solid #3b82f6; }
+        .status-unreachable { background-color: #fce7f3; color: #9d174d; border-left: 4px solid #ec4899; }
+        .status-expected_down { background-color: #f9fafb; color: #4b5563; border-left: 4px solid #9ca3af; }
+        .status-warn, .status-throttled { background-color: #fef3c7; color: #92400e; border-left: 4px solid #f59e0b; }
+        .status-pending, .status-init { background-color: #eff6ff; color: #1e40af; border-left: 4px solid #3b82f6; }
+        .status-stale { background-color: #f3f4f6; color: #6b7280; border-left: 4px dashed #9ca3af; font-style: italic; }
+        .status-unscheduled { background-color: #f9fafb; color: #6b7280; border-left: 4px solid #d1d5db; }
+        .latency-ok { color: #047857; }
+        .latency-warn { color: #b45309; font-weight: 600; }
+        .latency-crit { color: #b91c1c; font-weight: 700; }
+        /* Below Tailwind's md breakpoint the host table becomes stacked cards,
+           one per host, with each cell labelled from its data-label */
+        @media (max-width: 767px) {
+            .host-table thead { display: none; }
+            .host-table, .host-table tbody, .host-table tr, .host-table td { display: block; width: 100%; }
+            .host-table tr { padding: 0.5rem 0; }
+            .host-table td { display: flex; justify-content: space-between; gap: 1rem; padding: 0.25rem 1rem; white-space: normal; word-break: break-all; }
+            .host-table td[data-label]::before { content: attr(data-label); font-weight: 500; color: #6b7280; white-space: nowrap; word-break: normal; }
+            .host-table td[colspan] { display: block; }
+        }
         @keyframes pulse-down {
             0%, 100% { box-shadow: 0 0 10px rgba(239, 68, 68, 0.4); }
             50% { box-shadow: 0 0 20px rgba(239, 68, 68, 0.8); }
@@ -266,10 +8006,10 @@ const htmlTemplate = `
 <body class="p-4 md:p-8">
 
     <header class="mb-8">
-        <h1 class="text-4xl font-extrabold text-gray-900 tracking-tight">
+        <h1 class="text-2xl md:text-4xl font-extrabold text-gray-900 tracking-tight">
             Host Monitor Dashboard in GoLang for Linux
         </h1>
-        <p class="text-lg text-gray-500 mt-2">
+        <p class="text-base md:text-lg text-gray-500 mt-2">
             Real-time status via Server-Sent Events (SSE).
         </p>
     </header>
@@ -282,32 +8022,52 @@ const htmlTemplate = `
         Awaiting initial data stream...
     </div>
 
+    <!-- Screen readers announce status changes written here -->
+    <div id="statusAnnouncer" class="sr-only" role="status" aria-live="polite" aria-atomic="true"></div>
+
+    <div id="pollingBanner" class="hidden mb-4 px-6 py-3 rounded bg-yellow-100 text-yellow-700 text-sm font-medium" role="status">
+        Live updates unavailable, polling for changes instead.
+    </div>
+
+    <div id="maintenanceBanner" class="hidden mb-4 px-6 py-3 rounded bg-blue-100 text-blue-700 text-lg font-semibold" role="status"></div>
+
+    <div id="staleBanner" class="hidden mb-4 px-6 py-3 rounded bg-red-100 text-red-700 text-sm font-medium" role="alert"></div>
+
     <div id="dashboard" class="hidden">
-        <div class="grid grid-cols-1 lg:grid-cols-3 gap-6 mb-8">
+        <div class="grid grid-cols-1 md:grid-cols-2 lg:grid-cols-5 gap-4 md:gap-6 mb-8">
             <!-- Summary Cards will go here -->
-            <div id="totalHosts" class="card bg-white p-6 rounded-xl shadow-lg border-l-4 border-gray-200">
+            <div id="totalHosts" class="card bg-white p-4 md:p-6 rounded-xl shadow-lg border-l-4 border-gray-200">
                 <p class="text-sm font-medium text-gray-500">Total Hosts</p>
                 <p class="text-3xl font-bold text-gray-900 mt-1">0</p>
             </div>
-            <div id="upHosts" class="card bg-white p-6 rounded-xl shadow-lg status-up">
+            <div id="upHosts" class="card bg-white p-4 md:p-6 rounded-xl shadow-lg status-up">
                 <p class="text-sm font-medium text-gray-600">Hosts UP</p>
                 <p class="text-3xl font-bold text-green-700 mt-1">0</p>
             </div>
-            <div id="downHosts" class="card bg-white p-6 rounded-xl shadow-lg border-l-4 border-gray-200">
-                <p class="text-sm font-medium text-gray-600">Hosts DOWN</p>
+            <div id="warnHosts" class="card bg-white p-4 md:p-6 rounded-xl shadow-lg status-warn">
+                <p class="text-sm font-medium text-gray-600">Hosts WARN</p>
+                <p class="text-3xl font-bold text-amber-700 mt-1">0</p>
+            </div>
+            <div id="downHosts" class="card bg-white p-4 md:p-6 rounded-xl shadow-lg border-l-4 border-gray-200">
+                <p class="text-sm font-medium text-gray-600">Hosts DOWN <span id="expectedDownNote" class="hidden font-normal text-gray-500"></span></p>
                 <p class="text-3xl font-bold text-red-700 mt-1">0</p>
             </div>
+            <div id="pendingHosts" class="card bg-white p-4 md:p-6 rounded-xl shadow-lg status-pending{{if .HidePending}} hidden{{end}}">
+                <p class="text-sm font-medium text-gray-600">Hosts Pending</p>
+                <p class="text-3xl font-bold text-blue-700 mt-1">0</p>
+            </div>
         </div>
 
         <h2 class="text-2xl font-semibold text-gray-800 mb-4">Host Details</h2>
         <div class="shadow-xl rounded-xl overflow-hidden bg-white">
-            <table class="min-w-full divide-y divide-gray-200">
+            <table class="host-table min-w-full divide-y divide-gray-200">
                 <thead class="bg-gray-50">
                     <tr>
                         <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">Host</th>
                         <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">Status</th>
                         <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">Latency (ms)</th>
                         <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">Packet Loss (%)</th>
+                        <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">Protocol</th>
                         <th class="px-6 py-3 text-left text-xs font-medium text-gray-500 uppercase tracking-wider">Last Check</th>
                     </tr>
                 </thead>
@@ -316,8 +8076,16 @@ const htmlTemplate = `
                 </tbody>
             </table>
         </div>
+
+        <h2 class="text-2xl font-semibold text-gray-800 mt-8 mb-4">Recent Events</h2>
+        <div class="shadow-xl rounded-xl bg-white max-h-80 overflow-y-auto">
+            <ul id="activityLog" class="divide-y divide-gray-200 text-sm">
+                <li id="activityEmpty" class="px-6 py-4 text-gray-500">No status changes yet.</li>
+            </ul>
+        </div>
     </div>
 
+    <script src="/assets/chart.js"></script>
     <script>
         document.addEventListener('DOMContentLoaded', () => {
             const loadingEl = document.getElementById('loading');
@@ -327,51 +8095,497 @@ const htmlTemplate = `
             // Summary Elements
             const totalHostsEl = document.querySelector('#totalHosts p:last-child');
             const upHostsEl = document.querySelector('#upHosts p:last-child');
+            const warnHostsEl = document.querySelector('#warnHosts p:last-child');
             const downHostsEl = document.querySelector('#downHosts p:last-child');
+            const pendingHostsEl = document.querySelector('#pendingHosts p:last-child');
+            const expectedDownNoteEl = document.getElementById('expectedDownNote');
             const downHostCard = document.getElementById('downHosts');
 
-            // Open the SSE connection to the server
-            const eventSource = new EventSource('/events');
+            // Host whose detail row is expanded, and the last payload so a
+            // click can re-render without waiting for the next push
+            let selectedHost = null;
+            let lastStatuses = {};
 
-            eventSource.onmessage = (event) => {
-                try {
-                    // Data is received as a single JSON object (map of hosts)
-                    const data = JSON.parse(event.data);
-                    
-                    // Show the dashboard once data starts flowing
-                    loadingEl.classList.add('hidden');
-                    dashboardEl.classList.remove('hidden');
+            // Latency chart of the selected host, refetched from its
+            // history whenever it has been checked again since
+            let chart = { host: null, lastCheck: null, svg: '' };
+
+            function refreshChart(hostKey, status) {
+                if (chart.host === hostKey && chart.lastCheck === status.lastCheck) return;
+                chart = { host: hostKey, lastCheck: status.lastCheck, svg: chart.host === hostKey ? chart.svg : '' };
+                fetch('/api/hosts/' + encodeURIComponent(hostKey) + '/history')
+                    .then(response => response.ok ? response.json() : null)
+                    .then(history => {
+                        // Peer hosts have no local history, so get no chart
+                        if (!history || chart.host !== hostKey) return;
+                        chart.svg = latencyChart(history.checks);
+                        const el = document.getElementById('latencyChart');
+                        if (el) el.innerHTML = chart.svg;
+                    })
+                    .catch(err => console.error('Failed to load latency history:', err));
+            }
+
+            // Latency colour thresholds in ms from -latency-warn-ms and -latency-crit-ms (0 = off)
+            const latencyWarnMs = {{.LatencyWarnMs}};
+            const latencyCritMs = {{.LatencyCritMs}};
+
+            // latencyClass buckets a latency against the thresholds
+            function latencyClass(ms) {
+                if (!(ms > 0)) return '';
+                if (latencyCritMs > 0 && ms >= latencyCritMs) return 'latency-crit';
+                if (latencyWarnMs > 0 && ms >= latencyWarnMs) return 'latency-warn';
+                return 'latency-ok';
+            }
+
+            tableBody.addEventListener('click', (event) => {
+                const row = event.target.closest('tr[data-host]');
+                if (!row) return;
+                selectedHost = selectedHost === row.dataset.host ? null : row.dataset.host;
+                renderDashboard(lastStatuses);
+            });
+
+            // Our copy of the statuses, from the stream or from polling
+            let hostStates = {};
+
+            // The server's clock when it sent the latest data, and the
+            // smallest difference seen between our clock and its. Clocks
+            // rarely agree, but the difference stays about the same while
+            // updates arrive promptly, so the data's age can be measured
+            // in the server's time.
+            let lastServerTime = null;
+            let clockOffset = Infinity;
+
+            // Shown while the whole monitor is in maintenance
+            const maintenanceBannerEl = document.getElementById('maintenanceBanner');
+
+            function showMaintenance(until) {
+                if (until) {
+                    maintenanceBannerEl.textContent = 'Maintenance mode active until ' + formatTime(until) + ': no alerts are being sent.';
+                    maintenanceBannerEl.classList.remove('hidden');
+                } else {
+                    maintenanceBannerEl.classList.add('hidden');
+                }
+            }
+
+            function showStatuses(statuses, serverTime) {
+                hostStates = statuses;
+                if (serverTime) {
+                    lastServerTime = serverTime;
+                    clockOffset = Math.min(clockOffset, Date.now() - serverTime);
+                }
+
+                // Show the dashboard once data starts flowing
+                loadingEl.classList.add('hidden');
+                dashboardEl.classList.remove('hidden');
+
+                announceTransitions(hostStates);
+                renderDashboard(hostStates);
+            }
+
+            // When the stream fails for longer than sseFallbackMs, or the
+            // browser gives up on it, the dashboard polls /api/status every
+            // pollIntervalMs (-dashboard-poll-interval) instead, until the
+            // stream is back
+            const pollIntervalMs = {{.PollIntervalMs}};
+            const sseFallbackMs = 10000;
+            const pollingBannerEl = document.getElementById('pollingBanner');
+            let eventSource = null;
+            let failingSince = null;
+            let pollTimer = null;
+
+            // Open the SSE connection to the server. The stream is delta
+            // encoded: full snapshots replace our copy of the statuses and
+            // the events in between only carry the hosts that changed.
+            function connect() {
+                eventSource = new EventSource('/events?delta=1');
+
+                eventSource.onopen = () => {
+                    failingSince = null;
+                    stopPolling();
+                };
+
+                eventSource.onmessage = (event) => {
+                    try {
+                        const data = JSON.parse(event.data);
+                        const serverTime = Date.parse(data.serverTime);
+                        showMaintenance(data.maintenanceUntil);
+                        if (data.full) {
+                            showStatuses(data.hosts, serverTime);
+                        } else {
+                            Object.assign(hostStates, data.hosts);
+                            (data.removed || []).forEach(host => delete hostStates[host]);
+                            showStatuses(hostStates, serverTime);
+                        }
+                    } catch (e) {
+                        console.error("Error parsing SSE JSON data:", e);
+                        // Log the raw data to check format issues
+                        console.log("Raw data:", event.data);
+                    }
+                };
+
+                // The browser reconnects by itself unless the response was
+                // not a stream at all, e.g. an error page from a proxy
+                eventSource.onerror = (err) => {
+                    console.error("EventSource failed:", err);
+                    if (failingSince === null) failingSince = Date.now();
+                    if (eventSource.readyState === EventSource.CLOSED) {
+                        startPolling();
+                    } else {
+                        setTimeout(() => {
+                            if (failingSince !== null && Date.now() - failingSince >= sseFallbackMs) startPolling();
+                        }, sseFallbackMs);
+                    }
+                };
+            }
+
+            function startPolling() {
+                if (pollTimer !== null) return;
+                pollingBannerEl.classList.remove('hidden');
+                poll();
+                pollTimer = setInterval(poll, pollIntervalMs);
+            }
+
+            function stopPolling() {
+                if (pollTimer === null) return;
+                clearInterval(pollTimer);
+                pollTimer = null;
+                pollingBannerEl.classList.add('hidden');
+            }
+
+            function poll() {
+                fetch('/api/status')
+                    .then(response => {
+                        if (!response.ok) throw new Error('HTTP ' + response.status);
+                        return response.json();
+                    })
+                    .then(data => {
+                        showMaintenance(data.maintenanceUntil);
+                        showStatuses(data.hosts, Date.parse(data.serverTime));
+                    })
+                    .catch(err => console.error('Polling /api/status failed:', err));
+
+                // A stream the browser gave up on is retried now and then
+                if (eventSource.readyState === EventSource.CLOSED) {
+                    connect();
+                }
+            }
+
+            connect();
 
-                    renderDashboard(data);
+            // Warn once no data has arrived for twice the interval it should
+            // come in: pushes are sent at least every pushIntervalMs, and
+            // polls every pollIntervalMs
+            const pushIntervalMs = {{.PushIntervalMs}};
+            const staleBannerEl = document.getElementById('staleBanner');
+
+            setInterval(() => {
+                if (lastServerTime === null) return;
+                const ageMs = Date.now() - clockOffset - lastServerTime;
+                const expectedMs = pollTimer !== null ? pollIntervalMs : pushIntervalMs;
+                if (ageMs > 2 * expectedMs) {
+                    staleBannerEl.textContent = 'Data may be stale (last update ' + Math.round(ageMs / 1000) + 's ago).';
+                    staleBannerEl.classList.remove('hidden');
+                } else {
+                    staleBannerEl.classList.add('hidden');
+                }
+            }, 1000);
+
+            // Recent Events: one entry per transition, newest first
+            const activityLogEl = document.getElementById('activityLog');
+            const activityEmptyEl = document.getElementById('activityEmpty');
+            const maxActivityEntries = 50;
+            const transitionSource = new EventSource('/events/transitions');
+
+            transitionSource.onmessage = (event) => {
+                try {
+                    addActivity(JSON.parse(event.data));
                 } catch (e) {
-                    console.error("Error parsing SSE JSON data:", e);
-                    // Log the raw data to check format issues
-                    console.log("Raw data:", event.data); 
+                    console.error("Error parsing transition event:", e);
                 }
             };
 
-            eventSource.onerror = (err) => {
-                console.error("EventSource failed:", err);
-                eventSource.close();
-            };
+            // announceTransitions tells screen readers about hosts whose
+            // lastTransition moved since the previous push. Pushes that only
+            // refresh latencies, the first snapshot, and hosts coming out of
+            // PENDING as UP stay silent.
+            const announcerEl = document.getElementById('statusAnnouncer');
+            const maxAnnounced = 5;
+            let seenTransitions = null;
+
+            function announceTransitions(statuses) {
+                const messages = [];
+                const seen = {};
+                Object.keys(statuses).forEach(key => {
+                    const status = statuses[key];
+                    seen[key] = { at: status.lastTransition, status: status.status };
+                    const previous = seenTransitions && seenTransitions[key];
+                    if (!previous || previous.at === status.lastTransition) return;
+                    if (previous.status === 'PENDING' && status.status === 'UP') return;
+                    messages.push((status.displayName || status.host) + ' is now ' + status.status);
+                });
+                seenTransitions = seen;
+
+                if (messages.length > maxAnnounced) {
+                    announcerEl.textContent = messages.length + ' hosts changed status.';
+                } else if (messages.length > 0) {
+                    announcerEl.textContent = messages.join('. ') + '.';
+                }
+            }
+
+            // addActivity prepends a transition to the log, dropping the oldest
+            // entries beyond maxActivityEntries
+            function addActivity(transition) {
+                const known = lastStatuses[transition.host];
+                const name = known && known.displayName ? known.displayName : transition.host;
+                let colour = 'text-red-700';
+                let verb = 'went ' + transition.newStatus;
+                if (transition.newStatus === 'UP') {
+                    colour = 'text-green-700';
+                    verb = 'recovered';
+                } else if (transition.newStatus === 'WARN' || transition.newStatus === 'THROTTLED') {
+                    colour = 'text-amber-700';
+                } else if (transition.newStatus === 'SLO_OK') {
+                    colour = 'text-green-700';
+                } else if (transition.newStatus === 'EXPECTED_DOWN') {
+                    colour = 'text-gray-600';
+                }
+
+                const item = document.createElement('li');
+                item.className = 'px-6 py-3 flex justify-between gap-4';
+                // Identifies the failure so an incident can take its place
+                item.dataset.host = transition.host;
+                item.dataset.time = transition.timestamp;
+                item.innerHTML =
+                    '<span><span class="font-medium text-gray-900" title="' + escapeHtml(transition.host) + '">' + escapeHtml(name) + '</span> ' +
+                        '<span class="font-bold ' + colour + '">' + escapeHtml(verb) + '</span>' +
+                        '<span class="text-gray-500"> (was ' + escapeHtml(transition.oldStatus) + ')</span>' +
+                        (transition.error ? '<span class="text-gray-500">: ' + escapeHtml(transition.error) + '</span>' : '') +
+                    '</span>' +
+                    '<span class="text-gray-500 whitespace-nowrap">' + formatTime(transition.timestamp) + '</span>';
+
+                activityEmptyEl.remove();
+                activityLogEl.prepend(item);
+                while (activityLogEl.children.length > maxActivityEntries) {
+                    activityLogEl.lastElementChild.remove();
+                }
+                if (transition.newStatus !== transition.oldStatus) scheduleIncidents();
+            }
+
+            // Hosts failing together are grouped by the server into incidents. A
+            // burst of transitions triggers one fetch of /api/incidents, after
+            // which each incident replaces its members' failure entries.
+            let incidentTimer = null;
+
+            function scheduleIncidents() {
+                clearTimeout(incidentTimer);
+                incidentTimer = setTimeout(() => {
+                    fetch('/api/incidents')
+                        .then(response => response.ok ? response.json() : Promise.reject(response.status))
+                        .then(data => data.incidents.forEach(showIncident))
+                        .catch(err => console.error("Error fetching incidents:", err));
+                }, 1000);
+            }
+
+            function showIncident(incident) {
+                const members = Array.from(activityLogEl.children).filter(item =>
+                    incident.hosts.some(m => m.host === item.dataset.host && new Date(m.time).getTime() === new Date(item.dataset.time).getTime()));
+                let item = document.getElementById('incident-' + incident.id);
+                if (!item && members.length === 0) return; // From before this page was loaded
+                if (!item) {
+                    item = document.createElement('li');
+                    item.id = 'incident-' + incident.id;
+                    item.className = 'px-6 py-3 flex justify-between gap-4';
+                    activityLogEl.insertBefore(item, members[0]);
+                }
+                members.forEach(member => member.remove());
+
+                const names = incident.hosts.map(m => {
+                    const known = lastStatuses[m.host];
+                    return escapeHtml(known && known.displayName ? known.displayName : m.host);
+                });
+                item.innerHTML =
+                    '<span><span class="font-bold ' + (incident.end ? 'text-green-700' : 'text-red-700') + '">Incident ' + incident.id +
+                        (incident.end ? ' resolved' : '') + '</span>' +
+                        '<span class="text-gray-900">: ' + incident.hosts.length + ' hosts failed together</span>' +
+                        '<span class="text-gray-500"> (' + names.join(', ') + ')</span>' +
+                    '</span>' +
+                    '<span class="text-gray-500 whitespace-nowrap">' + formatTime(incident.start) + '</span>';
+            }
+
+            // escapeHtml makes server-provided strings safe to inject into markup
+            function escapeHtml(value) {
+                return String(value)
+                    .replace(/&/g, '&amp;')
+                    .replace(/</g, '&lt;')
+                    .replace(/>/g, '&gt;')
+                    .replace(/"/g, '&quot;');
+            }
+
+            // formatTime renders a Go timestamp, treating the zero time as unset
+            function formatTime(value) {
+                if (!value || value.startsWith('0001-01-01')) return '';
+                return new Date(value).toLocaleString();
+            }
+
+            // trendArrow shows which way latency is heading against its recent average;
+            // rising latency is the bad direction
+            function trendArrow(trend) {
+                const arrows = {
+                    up: ['&#9650;', 'text-red-700', 'Latency trending up'],
+                    down: ['&#9660;', 'text-green-700', 'Latency trending down'],
+                    flat: ['&#9654;', 'text-gray-500', 'Latency steady'],
+                };
+                if (!arrows[trend]) return '';
+                const [arrow, color, title] = arrows[trend];
+                return ' <span class="ml-1 text-xs ' + color + '" title="' + title + '">' + arrow + '</span>';
+            }
+
+            // budgetBar shows how much of a host's monthly error budget is left as a small
+            // bar that empties as the budget burns down, red once it is spent
+            function budgetBar(status) {
+                const remaining = status.errorBudgetRemaining;
+                if (remaining === undefined || remaining === null) return '';
+                const width = 60, height = 6;
+                const fill = Math.max(0, Math.min(100, remaining)) / 100 * width;
+                const colour = remaining > 50 ? '#22c55e' : '#f59e0b';
+                return '<svg class="inline-block ml-2 align-middle" width="' + width + '" height="' + height + '" viewBox="0 0 ' + width + ' ' + height + '">' +
+                    '<title>' + remaining.toFixed(1) + '% of the error budget for ' + status.sloTarget + '% uptime left this month</title>' +
+                    '<rect width="' + width + '" height="' + height + '" rx="2" fill="' + (remaining > 0 ? '#e5e7eb' : '#ef4444') + '"></rect>' +
+                    '<rect width="' + fill.toFixed(1) + '" height="' + height + '" rx="2" fill="' + colour + '"></rect></svg>';
+            }
+
+            // sparkline draws recent latencies (sent with -include-history) as a small inline chart
+            function sparkline(values) {
+                if (!values || values.length < 2) return '';
+                const width = 80, height = 20;
+                const peak = Math.max(...values) || 1;
+                const points = values.map((value, i) =>
+                    (i * width / (values.length - 1)).toFixed(1) + ',' + (height - value / peak * height).toFixed(1)
+                ).join(' ');
+                return '<svg class="inline-block ml-2 align-middle" width="' + width + '" height="' + height + '" viewBox="0 0 ' + width + ' ' + height + '">' +
+                    '<polyline fill="none" stroke="currentColor" stroke-width="1.5" points="' + points + '"></polyline></svg>';
+            }
+
+            // formatDuration renders a Go duration (nanoseconds) in its largest sensible units
+            function formatDuration(ns) {
+                if (!ns) return '';
+                let seconds = Math.round(ns / 1e9);
+                if (seconds < 60) return seconds + 's';
+                const units = [['d', 86400], ['h', 3600], ['m', 60]];
+                const parts = [];
+                for (const [suffix, size] of units) {
+                    if (seconds >= size) {
+                        parts.push(Math.floor(seconds / size) + suffix);
+                        seconds %= size;
+                    }
+                }
+                return parts.slice(0, 2).join(' ');
+            }
+
+            // familyBadge marks how one address family fared in a -dual-stack check
+            function familyBadge(label, familyStatus) {
+                if (!familyStatus) return '';
+                const colour = familyStatus === 'UP' ? 'bg-green-100 text-green-700' :
+                    familyStatus === 'DOWN' ? 'bg-red-100 text-red-700' : 'bg-yellow-100 text-yellow-700';
+                return ' <span class="ml-1 px-1.5 py-0.5 rounded text-xs font-normal ' + colour + '" title="' +
+                    label.replace('v', 'IPv') + ' ' + escapeHtml(familyStatus) + '">' + label + '</span>';
+            }
+
+            // downFor describes how long a DOWN host has gone without an UP check
+            function downFor(status) {
+                if (status.status !== 'DOWN' || !formatTime(status.lastSuccess)) return '';
+                const ns = (Date.now() - new Date(status.lastSuccess).getTime()) * 1e6;
+                return ' for ' + (formatDuration(ns) || '0s');
+            }
+
+            // renderDetails builds the expanded row showing every known field for a host
+            function renderDetails(status) {
+                const fields = [
+                    ['Target', status.host],
+                    ['Region', status.region],
+                    ['Group', status.group],
+                    ['Interval', status.intervalMs ? status.intervalMs + 'ms' : ''],
+                    ['Schedule', status.schedule],
+                    ['Expected up', status.expectedUp],
+                    ['Checks', status.checkCount],
+                    ['Uptime', status.checkCount ? status.uptimePercent.toFixed(2) + '%' : ''],
+                    ['MTBF', formatDuration(status.mtbf)],
+                    ['MTTR', formatDuration(status.mttr)],
+                    ['Last transition', formatTime(status.lastTransition)],
+                    ['Last success', formatTime(status.lastSuccess)],
+                    ['Acknowledged', formatTime(status.ackedAt)],
+                    ['IPv4', status.ipv4Status],
+                    ['IPv6', status.ipv6Status],
+                    ['TLS version', status.tlsVersion],
+                    ['TLS cipher', status.tlsCipher],
+                    ['Redirects', status.redirects],
+                    ['Response size', status.wireBytes ? status.wireBytes + ' bytes' +
+                        (status.contentEncoding ? ' (' + status.contentEncoding + ', ' + status.bodyBytes + ' decoded)' : '') : ''],
+                    ['Metric', status.metric],
+                    ['Last error', status.lastError],
+                    ['Failure reason', status.failureReason],
+                    ['Next check', formatTime(status.retryAt)],
+                    ['Latency SLO', status.sloMs ? status.sloMs + 'ms' : ''],
+                    ['Uptime SLO', status.sloTarget ? status.sloTarget + '%' : ''],
+                    ['Error budget left', status.errorBudgetRemaining != null ? status.errorBudgetRemaining.toFixed(2) + '% this month' : ''],
+                    ['SLO breaches', status.sloMs ? (status.sloBreaches || 0) + ' (' + (status.sloBreachPercent || 0).toFixed(1) + '% in window)' : ''],
+                ];
+
+                let items = '';
+                fields.forEach(([label, value]) => {
+                    if (value === undefined || value === null || value === '') return;
+                    items += '<div><dt class="font-medium text-gray-500">' + label + '</dt>' +
+                        '<dd class="text-gray-900 break-all">' + escapeHtml(value) + '</dd></div>';
+                });
+
+                return '<tr class="bg-gray-50"><td colspan="6" class="px-6 py-4 text-sm">' +
+                    '<dl class="grid grid-cols-1 md:grid-cols-3 gap-x-6 gap-y-2">' + items + '</dl>' +
+                    '<div id="latencyChart" class="mt-4">' + chart.svg + '</div>' +
+                    '</td></tr>';
+            }
 
             function renderDashboard(statuses) {
+                lastStatuses = statuses;
                 let upCount = 0;
+                let warnCount = 0;
                 let downCount = 0;
+                let pendingCount = 0;
+                let expectedDownCount = 0;
                 
                 let html = '';
                 
-                // Get sorted host keys for stable table order
-                const hosts = Object.keys(statuses).sort();
+                // Sort by group, then by the name shown, then by key, for a stable table order
+                const label = key => statuses[key].displayName || statuses[key].host || key;
+                const group = key => statuses[key].group || '';
+                const hosts = Object.keys(statuses).sort((a, b) =>
+                    group(a).localeCompare(group(b)) ||
+                    label(a).localeCompare(label(b)) || (a < b ? -1 : a > b ? 1 : 0));
+
+                // Grouped hosts get a header row per group; ungrouped ones sort first
+                const grouped = hosts.some(hostKey => group(hostKey) !== '');
+                let currentGroup = null;
 
                 hosts.forEach(hostKey => {
                     const status = statuses[hostKey];
+
+                    if (grouped && group(hostKey) !== currentGroup) {
+                        currentGroup = group(hostKey);
+                        html += '<tr class="bg-gray-100"><td colspan="6" class="px-6 py-2 text-xs font-semibold uppercase tracking-wider text-gray-600">' +
+                            escapeHtml(currentGroup || 'Ungrouped') + '</td></tr>';
+                    }
                     
                     // The 'status' field is correct (lowercase)
-                    const statusClass = 'status-' + status.status.toLowerCase();
+                    // Stale rows get their own style so frozen data never looks current,
+                    // as do hosts outside their check schedule
+                    const statusClass = status.stale ? 'status-stale' :
+                        status.notScheduled ? 'status-unscheduled' : 'status-' + status.status.toLowerCase();
                     
+                    // Same categories as the server's statusCategory, so the cards always add up
                     if (status.status === 'UP') upCount++;
-                    if (status.status === 'DOWN') downCount++;
+                    else if (status.status === 'WARN' || status.status === 'THROTTLED') warnCount++;
+                    else if (status.status === 'PENDING' || status.status === 'INIT') pendingCount++;
+                    else if (status.status === 'EXPECTED_DOWN') expectedDownCount++;
+                    else downCount++;
 
                     let lastCheckTime = 'N/A';
                     
@@ -382,30 +8596,50 @@ const htmlTemplate = `
                         lastCheckTime = new Date(status.lastCheck).toLocaleTimeString();
                     }
 
-                    html += '<tr class="hover:bg-gray-50 ' + statusClass + '">' +
+                    html += '<tr class="hover:bg-gray-50 cursor-pointer ' + statusClass + '" data-host="' + escapeHtml(hostKey) + '">' +
                         // FIX: Use status.host (lowercase)
-                        '<td class="px-6 py-4 whitespace-nowrap text-sm font-medium text-gray-900">' + status.host + '</td>' +
-                        '<td class="px-6 py-4 whitespace-nowrap text-sm font-bold">' + status.status + '</td>' +
+                        '<td class="px-6 py-4 whitespace-nowrap text-sm font-medium text-gray-900" title="' + escapeHtml(status.host) + '">' +
+                            escapeHtml(status.displayName || status.host) +
+                            (status.critical ? ' <span class="ml-2 px-2 py-0.5 rounded bg-red-100 text-xs font-semibold text-red-700">CRITICAL</span>' : '') +
+                            (status.region ? ' <span class="ml-2 px-2 py-0.5 rounded bg-gray-100 text-xs text-gray-600">' + escapeHtml(status.region) + '</span>' : '') +
+                        '</td>' +
+                        '<td data-label="Status" class="px-6 py-4 whitespace-nowrap text-sm font-bold" title="' + escapeHtml(status.lastError || '') + '">' + status.status + downFor(status) +
+                            (status.ackedAt ? ' <span class="ml-1 px-1.5 py-0.5 rounded bg-gray-100 text-xs font-normal text-gray-600">ACKED</span>' : '') +
+                            familyBadge('v4', status.ipv4Status) + familyBadge('v6', status.ipv6Status) + budgetBar(status) + (status.stale ? ' (STALE)' : status.notScheduled ? ' (NOT SCHEDULED)' : '') + '</td>' +
                         
                         // FIX: Use status.latencyMs (camelCase) which caused the 'toFixed' error
-                        '<td class="px-6 py-4 whitespace-nowrap text-sm text-gray-700">' +
-                            (status.latencyMs > 0 ? status.latencyMs.toFixed(2) + 'ms' : '---') +
+                        '<td data-label="Latency" class="px-6 py-4 whitespace-nowrap text-sm text-gray-700">' +
+                            (status.latencyMs > 0 ? '<span class="' + latencyClass(status.latencyMs) + '">' + status.latencyMs.toFixed(2) + ' ms</span>' + trendArrow(status.latencyTrend) : '---') +
+                            sparkline(status.latencyHistory) +
                         '</td>' +
                         
                         // FIX: Use status.packetLoss (camelCase) which also caused the 'toFixed' error
-                        '<td class="px-6 py-4 whitespace-nowrap text-sm text-gray-700">' +
+                        '<td data-label="Packet Loss" class="px-6 py-4 whitespace-nowrap text-sm text-gray-700">' +
                             status.packetLoss.toFixed(1) + '%' +
                         '</td>' +
-                        '<td class="px-6 py-4 whitespace-nowrap text-sm text-gray-500">' +
+                        '<td data-label="Protocol" class="px-6 py-4 whitespace-nowrap text-sm text-gray-700">' +
+                            escapeHtml(status.proto || '---') +
+                        '</td>' +
+                        '<td data-label="Last Check" class="px-6 py-4 whitespace-nowrap text-sm text-gray-500">' +
                             lastCheckTime +
                         '</td>' +
                     '</tr>';
+
+                    if (hostKey === selectedHost) {
+                        refreshChart(hostKey, status);
+                        html += renderDetails(status);
+                    }
                 });
 
                 // Update Summary Cards
                 totalHostsEl.textContent = hosts.length;
                 upHostsEl.textContent = upCount;
+                warnHostsEl.textContent = warnCount;
                 downHostsEl.textContent = downCount;
+                pendingHostsEl.textContent = pendingCount;
+                // Hosts down outside their expected_up window are not outages
+                expectedDownNoteEl.textContent = '(+' + expectedDownCount + ' expected)';
+                expectedDownNoteEl.classList.toggle('hidden', expectedDownCount === 0);
                 
                 // Update Down Card visual status
                 if (downCount > 0) {
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCheckPanicIsRecovered makes every HTTP check panic and expects the
+// host to be recorded as DOWN with ReasonPanic and to keep being checked.
+func TestCheckPanicIsRecovered(t *testing.T) {
+	// The check client clones the default transport, and the client calls
+	// Proxy on the checking goroutine, so this panics inside the check.
+	base := http.DefaultTransport.(*http.Transport)
+	proxy := base.Proxy
+	base.Proxy = func(*http.Request) (*url.URL, error) { panic("injected panic") }
+	defer func() { base.Proxy = proxy }()
+
+	const host = "127.0.0.1:1"
+	mu.Lock()
+	// Seed a successful check so the failure is DOWN, not UNREACHABLE.
+	hostStatsMap[host] = &hostStats{TotalChecks: 1, UpChecks: 1}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		delete(hostStatuses, host)
+		delete(hostStatsMap, host)
+		delete(hostConfigs, host)
+		mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		monitorHost(ctx, hostSpec{Host: host, Target: host}, 20*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.RLock()
+		status := hostStatuses[host]
+		checks, state, reason := status.CheckCount, status.Status, status.FailureReason
+		mu.RUnlock()
+		if checks >= 2 {
+			if state != "DOWN" {
+				t.Errorf("status = %q, want DOWN", state)
+			}
+			if reason != ReasonPanic {
+				t.Errorf("failure reason = %q, want %q", reason, ReasonPanic)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("host checked %d times after a panic, want at least 2", checks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr string // Substring of the error, empty when spec is valid
+	}{
+		{spec: "*/5 9-16 * * 1-5"},
+		{spec: "0 9 * * MON-FRI"},
+		{spec: "0 0 * * mon-sun"},
+		{spec: "0 0 * * 7"},
+		{spec: "15,45 8-18/2 1 jan,jul *"},
+		{spec: "@hourly"},
+		{spec: "CRON_TZ=America/New_York @daily"},
+		{spec: "* * *", wantErr: "five fields"},
+		{spec: "60 * * * *", wantErr: "not between 0 and 59"},
+		{spec: "* 24 * * *", wantErr: "not between 0 and 23"},
+		{spec: "* * 0 * *", wantErr: "not between 1 and 31"},
+		{spec: "* * * 13 *", wantErr: "not between 1 and 12"},
+		{spec: "* * * * fun", wantErr: "not between 0 and 7"},
+		{spec: "*/0 * * * *", wantErr: "invalid step"},
+		{spec: "* 17-9 * * *", wantErr: "runs backwards"},
+		{spec: "0 0 30 feb *", wantErr: "never runs"},
+		{spec: "CRON_TZ=Nowhere/Atlantis * * * * *", wantErr: "unknown time zone"},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.spec)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("parseCron(%q) = %v, want no error", tt.spec, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("parseCron(%q) = %v, want an error containing %q", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from string
+		want string
+	}{
+		{"every minute", "* * * * *", "2026-10-16T10:00:30Z", "2026-10-16T10:01:00Z"},
+		{"step", "*/15 * * * *", "2026-10-16T10:15:00Z", "2026-10-16T10:30:00Z"},
+		{"next hour", "0 * * * *", "2026-10-16T10:59:00Z", "2026-10-16T11:00:00Z"},
+		{"next month", "0 0 1 * *", "2026-12-31T12:00:00Z", "2027-01-01T00:00:00Z"},
+		{"leap day", "0 0 29 2 *", "2026-10-16T00:00:00Z", "2028-02-29T00:00:00Z"},
+		// Business hours: every five minutes from 9:00 to 16:55 on weekdays
+		{"business hours", "*/5 9-16 * * mon-fri", "2026-10-16T12:02:00Z", "2026-10-16T12:05:00Z"},
+		{"business hours end of day", "*/5 9-16 * * 1-5", "2026-10-15T16:55:00Z", "2026-10-16T09:00:00Z"},
+		{"business hours over the weekend", "*/5 9-16 * * 1-5", "2026-10-16T16:55:00Z", "2026-10-19T09:00:00Z"},
+		// Both day fields restricted: either one matching counts
+		{"day of month or week", "0 0 1 * fri", "2026-10-13T00:00:00Z", "2026-10-16T00:00:00Z"},
+		{"time zone", "CRON_TZ=America/New_York 0 9 * * *", "2026-10-16T12:00:00Z", "2026-10-16T13:00:00Z"},
+		// The clocks go from 2:00 to 3:00 on 8 March 2026, so 2:30 doesn't
+		// happen that day
+		{"DST start skips the hour", "CRON_TZ=America/New_York 30 2 * * *", "2026-03-08T00:00:00-05:00", "2026-03-09T02:30:00-04:00"},
+		{"DST start steps over the gap", "CRON_TZ=America/New_York */15 * * * *", "2026-03-08T01:50:00-05:00", "2026-03-08T03:00:00-04:00"},
+		// The clocks go from 2:00 back to 1:00 on 1 November 2026
+		{"DST end runs once", "CRON_TZ=America/New_York 30 1 * * *", "2026-11-01T01:30:00-04:00", "2026-11-02T01:30:00-05:00"},
+		{"DST end repeated hour", "CRON_TZ=America/New_York */15 * * * *", "2026-11-01T01:20:00-05:00", "2026-11-01T01:30:00-05:00"},
+		// Midnight didn't happen on 4 November 2018 in São Paulo
+		{"DST start at midnight", "CRON_TZ=America/Sao_Paulo 0 * * * *", "2018-11-03T23:30:00-03:00", "2018-11-04T01:00:00-02:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, _ := time.Parse(time.RFC3339, tt.from)
+			want, _ := time.Parse(time.RFC3339, tt.want)
+			if got := c.next(from); !got.Equal(want) {
+				t.Errorf("next(%s) = %s, want %s", tt.from, got.Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
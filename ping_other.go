@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// listenPingSocket fails outside Unix, which has no unprivileged ping
+// sockets, so listenICMP opens a raw socket instead.
+func listenPingSocket(addr, source netip.Addr) (net.PacketConn, error) {
+	return nil, errors.New("ping sockets are not supported on this platform")
+}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+)
+
+// listenPingSocket opens an unprivileged ping socket for pinging addr from
+// source, if valid. Linux allows them for the groups in
+// net.ipv4.ping_group_range, and macOS for everyone.
+func listenPingSocket(addr, source netip.Addr) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if addr.Is6() {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fd), "ping")
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	if source.IsValid() {
+		if err := bindSource(conn, source); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bindSource binds a ping socket to a local address.
+func bindSource(conn net.PacketConn, source netip.Addr) error {
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{Addr: source.As4()}
+	if source.Is6() {
+		sa = &syscall.SockaddrInet6{Addr: source.As16()}
+	}
+	var bindErr error
+	if err := raw.Control(func(fd uintptr) { bindErr = syscall.Bind(int(fd), sa) }); err != nil {
+		return err
+	}
+	return bindErr
+}
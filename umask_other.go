@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// setUmask does nothing outside Unix, which has no umask; the socket's
+// permissions are left to the platform.
+func setUmask(mask int) int {
+	return 0
+}
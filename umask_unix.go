@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// setUmask sets the process's file mode creation mask and returns the
+// previous one.
+func setUmask(mask int) int {
+	return syscall.Umask(mask)
+}